@@ -95,7 +95,10 @@ func saveClient(db *bolt.DB, client *models.Account) error {
 	})
 }
 
-func modifyPermissions(db *bolt.DB, r io.Reader, account *models.Account, operation func([]string)) error {
+// modifyPermissions applies operation to the permissions in the request
+// body. Permissions being granted are validated first; ones being removed
+// are not, so that malformed permissions saved earlier can still be revoked.
+func modifyPermissions(db *bolt.DB, r io.Reader, account *models.Account, operation func([]string), validate bool) error {
 	var perms struct {
 		Permissions []string `json:"permissions"`
 	}
@@ -103,6 +106,11 @@ func modifyPermissions(db *bolt.DB, r io.Reader, account *models.Account, operat
 	if err != nil {
 		return err
 	}
+	if validate {
+		if err = models.ValidatePermissions(perms.Permissions); err != nil {
+			return err
+		}
+	}
 	operation(perms.Permissions)
 	return saveClient(db, account)
 }
@@ -160,12 +168,17 @@ func updateClient(c web.C, w http.ResponseWriter, r *http.Request) {
 			Permissions []string `json:"permissions"`
 		}{}
 		if err = json.NewDecoder(r.Body).Decode(&params); err == nil {
+			err = models.ValidatePermissions(params.Permissions)
+		}
+		if err == nil {
 			client.SetDatastore(params.Datastore)
 			client.SetPermissions(params.Permissions)
 			err = saveClient(db, &client)
 		}
 	}
-	if err == nil {
+	if _, ok := err.(models.InvalidPermission); ok {
+		invalid(err, w)
+	} else if err == nil {
 		w.WriteHeader(http.StatusAccepted)
 		w.Write([]byte(""))
 	} else {
@@ -181,7 +194,11 @@ func addPermissions(c web.C, w http.ResponseWriter, r *http.Request) {
 	}
 	clientAccount, err, _ := findClient(db, c, false)
 	if err == nil {
-		err = modifyPermissions(db, r.Body, &clientAccount, (&clientAccount).AddPermissions)
+		err = modifyPermissions(db, r.Body, &clientAccount, (&clientAccount).AddPermissions, true)
+	}
+	if _, ok := err.(models.InvalidPermission); ok {
+		invalid(err, w)
+		return
 	}
 	switch err {
 	case nil:
@@ -201,7 +218,7 @@ func removePermissions(c web.C, w http.ResponseWriter, r *http.Request) {
 	}
 	clientAccount, err, _ := findClient(db, c, false)
 	if err == nil {
-		err = modifyPermissions(db, r.Body, &clientAccount, (&clientAccount).RemovePermissions)
+		err = modifyPermissions(db, r.Body, &clientAccount, (&clientAccount).RemovePermissions, false)
 	}
 	switch err {
 	case nil:
@@ -221,9 +238,12 @@ func createClient(c web.C, w http.ResponseWriter, r *http.Request) {
 	}
 	client, err := models.NewAccount()
 	if err == nil {
-		err = modifyPermissions(db, r.Body, client, client.AddPermissions)
+		err = modifyPermissions(db, r.Body, client, client.AddPermissions, true)
 	}
-	if err != nil {
+	if _, ok := err.(models.InvalidPermission); ok {
+		invalid(err, w)
+		return
+	} else if err != nil {
 		unavailable(err, w)
 		return
 	}
@@ -313,4 +333,12 @@ func Register(root string) {
 	goji.Post(fmt.Sprintf("%s/accounts/:id/permissions", root), addPermissions)
 	goji.Delete(fmt.Sprintf("%s/accounts/:id/permissions", root), removePermissions)
 	goji.Delete(fmt.Sprintf("%s/accounts/:id", root), revokeClient)
+
+	// Moderation
+	goji.Get(fmt.Sprintf("%s/accounts/:id/moderation", root), listModerationQueue)
+	goji.Post(fmt.Sprintf("%s/accounts/:id/moderation/:uuid/restore", root), restoreReportedGif)
+	goji.Delete(fmt.Sprintf("%s/accounts/:id/moderation/:uuid", root), removeReportedGif)
+
+	// Random selection
+	goji.Put(fmt.Sprintf("%s/accounts/:id/gifs/:uuid/weight", root), setGifWeight)
 }
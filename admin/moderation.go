@@ -0,0 +1,81 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/boltdb/bolt"
+	"github.com/csaunders/giftd/gifs"
+	"github.com/csaunders/giftd/middleware"
+	"github.com/csaunders/giftd/models"
+	"github.com/zenazn/goji/web"
+)
+
+func withClientDatastore(db *bolt.DB, c web.C, fn func(datastore *bolt.DB) error) error {
+	client, err, _ := findClient(db, c, false)
+	if err != nil {
+		return err
+	}
+	return middleware.WithDatastore(client.DatastoreName(), fn)
+}
+
+func listModerationQueue(c web.C, w http.ResponseWriter, r *http.Request) {
+	db, err := retrieveDb(c, w)
+	if err != nil {
+		return
+	}
+	var queue []gifs.ModerationEntry
+	err = withClientDatastore(db, c, func(datastore *bolt.DB) error {
+		queue, err = gifs.ModerationQueue(datastore)
+		return err
+	})
+	switch err {
+	case nil:
+		data, _ := json.Marshal(struct {
+			Queue []gifs.ModerationEntry `json:"queue"`
+		}{queue})
+		w.Write(data)
+	case models.RecordNotFound:
+		notFound(w)
+	default:
+		unavailable(err, w)
+	}
+}
+
+func restoreReportedGif(c web.C, w http.ResponseWriter, r *http.Request) {
+	db, err := retrieveDb(c, w)
+	if err != nil {
+		return
+	}
+	err = withClientDatastore(db, c, func(datastore *bolt.DB) error {
+		return gifs.RestoreGif(datastore, c.URLParams["uuid"])
+	})
+	switch err {
+	case nil:
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(""))
+	case models.RecordNotFound:
+		notFound(w)
+	default:
+		unavailable(err, w)
+	}
+}
+
+func removeReportedGif(c web.C, w http.ResponseWriter, r *http.Request) {
+	db, err := retrieveDb(c, w)
+	if err != nil {
+		return
+	}
+	err = withClientDatastore(db, c, func(datastore *bolt.DB) error {
+		return gifs.RemoveGif(datastore, c.URLParams["uuid"])
+	})
+	switch err {
+	case nil:
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(""))
+	case models.RecordNotFound:
+		notFound(w)
+	default:
+		unavailable(err, w)
+	}
+}
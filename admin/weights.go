@@ -0,0 +1,39 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/boltdb/bolt"
+	"github.com/csaunders/giftd/gifs"
+	"github.com/csaunders/giftd/models"
+	"github.com/zenazn/goji/web"
+)
+
+func setGifWeight(c web.C, w http.ResponseWriter, r *http.Request) {
+	db, err := retrieveDb(c, w)
+	if err != nil {
+		return
+	}
+	var params struct {
+		Weight float64 `json:"weight"`
+	}
+	if err = json.NewDecoder(r.Body).Decode(&params); err != nil {
+		invalid(err, w)
+		return
+	}
+	err = withClientDatastore(db, c, func(datastore *bolt.DB) error {
+		return gifs.SetWeight(datastore, c.URLParams["uuid"], params.Weight)
+	})
+	switch err {
+	case nil:
+		data, _ := json.Marshal(params)
+		w.Write(data)
+	case models.RecordNotFound:
+		notFound(w)
+	case gifs.ErrInvalidWeight:
+		invalid(err, w)
+	default:
+		unavailable(err, w)
+	}
+}
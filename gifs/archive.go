@@ -0,0 +1,241 @@
+package gifs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/csaunders/giftd/middleware"
+	"github.com/csaunders/giftd/models"
+	"github.com/zenazn/goji/web"
+)
+
+const defaultMaxArchiveBytes int = 100 << 20
+const defaultMaxArchiveEntries int = 1000
+const archiveChunkSize int = 50
+
+var errUnsupportedArchive error = errors.New("unsupported archive format")
+var errManifestFound error = errors.New("manifest found")
+
+type archiveResult struct {
+	File    string `json:"file"`
+	UUID    string `json:"uuid,omitempty"`
+	Created bool   `json:"created,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type pendingGif struct {
+	Result    int
+	Namespace string
+	UUID      string
+	Content   []byte
+	Meta      Metadata
+}
+
+func ignoredEntry(name string) bool {
+	return strings.HasPrefix(name, "__MACOSX/") || strings.HasPrefix(path.Base(name), ".")
+}
+
+// walkArchive calls fn with every regular file in the zip, tar or gzipped
+// tar archive held in data, stopping early if fn returns an error.
+func walkArchive(data []byte, maxEntries int, fn func(name string, r io.Reader, err error) error) error {
+	entries := 0
+	visit := func(name string, r io.Reader, err error) error {
+		if ignoredEntry(name) {
+			return nil
+		}
+		if entries++; entries > maxEntries {
+			return tooLarge("Archive has more than %d entries", maxEntries)
+		}
+		return fn(name, r, err)
+	}
+
+	switch {
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")):
+		archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return err
+		}
+		for _, file := range archive.File {
+			if file.FileInfo().IsDir() {
+				continue
+			}
+			rc, err := file.Open()
+			if err == nil {
+				err = visit(file.Name, rc, nil)
+				rc.Close()
+			} else {
+				err = visit(file.Name, nil, err)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		return walkTar(gz, visit)
+	case len(data) > 262 && string(data[257:262]) == "ustar":
+		return walkTar(bytes.NewReader(data), visit)
+	default:
+		return errUnsupportedArchive
+	}
+}
+
+func walkTar(r io.Reader, fn func(name string, r io.Reader, err error) error) error {
+	archive := tar.NewReader(r)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if !header.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		if err = fn(header.Name, archive, nil); err != nil {
+			return err
+		}
+	}
+}
+
+// readManifest returns the entries of an exported archive's manifest keyed by
+// file name, or an empty map if the archive has none.
+func readManifest(data []byte, maxEntries int) map[string]manifestEntry {
+	entries := map[string]manifestEntry{}
+	walkArchive(data, maxEntries, func(name string, r io.Reader, err error) error {
+		if name != manifestName || err != nil {
+			return nil
+		}
+		var m manifest
+		if err = json.NewDecoder(r).Decode(&m); err != nil {
+			return nil
+		}
+		for _, entry := range m.Gifs {
+			entries[entry.File] = entry
+		}
+		return errManifestFound
+	})
+	return entries
+}
+
+func storePending(db *bolt.DB, pending []pendingGif, results []archiveResult) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		for _, gif := range pending {
+			stored, created, err := storeGifTx(tx, []byte(gif.Namespace), []byte(gif.UUID), gif.Content, gif.Meta)
+			if err != nil {
+				return err
+			}
+			results[gif.Result].UUID = stored
+			results[gif.Result].Created = created
+		}
+		return nil
+	})
+}
+
+func importArchive(db *bolt.DB, c web.C, w http.ResponseWriter, r *http.Request) {
+	namespace := c.URLParams["namespace"]
+	account, _ := c.Env[middleware.AccountDetails].(models.Account)
+	bounds := limitsFor(c)
+	archiveBounds := bounds
+	archiveBounds.MaxBytes = int64(intSetting(c, "max-archive-bytes", defaultMaxArchiveBytes))
+	data, err := archiveBounds.read(r.Body)
+	if err != nil {
+		rejectContent(err, c, w, r)
+		return
+	}
+
+	keep := keepOriginal(r)
+	preserveNamespaces, _ := strconv.ParseBool(r.URL.Query().Get("preserve-namespaces"))
+	tags := parseTags(r.URL.Query().Get("tags"))
+	results := []archiveResult{}
+	pending := []pendingGif{}
+	maxEntries := intSetting(c, "max-archive-entries", defaultMaxArchiveEntries)
+	exported := readManifest(data, maxEntries)
+	err = walkArchive(data, maxEntries, func(name string, body io.Reader, err error) error {
+		if name == manifestName {
+			return nil
+		}
+		var content []byte
+		var meta Metadata
+		if err == nil {
+			content, meta, err = verifyGif(body, keep, bounds)
+		}
+		if err != nil {
+			results = append(results, archiveResult{File: name, Error: err.Error()})
+			return nil
+		}
+		uuid, err := models.GenUUID()
+		if err != nil {
+			return err
+		}
+
+		ns := namespace
+		meta.Title = path.Base(name)
+		meta.Source = sourceArchive
+		meta.UploadedAt = time.Now().UTC()
+		meta.AccountId = account.Id
+		meta.Tags = tags
+		if entry, ok := exported[name]; ok {
+			if len(entry.Metadata.Title) > 0 {
+				meta.Title = entry.Metadata.Title
+			}
+			meta.Tags = normalizeTags(append(append([]string{}, tags...), entry.Metadata.Tags...))
+			if preserveNamespaces && len(entry.Namespace) > 0 {
+				ns = entry.Namespace
+			}
+		}
+		if !validNamespace(ns) {
+			results = append(results, archiveResult{File: name, Error: invalidNamespaceMessage})
+			return nil
+		}
+		if !allowed(models.WriteAccess, ns, c) {
+			results = append(results, archiveResult{File: name, Error: "no write access to " + ns})
+			return nil
+		}
+		results = append(results, archiveResult{File: name})
+		pending = append(pending, pendingGif{len(results) - 1, ns, uuid, content, meta})
+		if len(pending) < archiveChunkSize {
+			return nil
+		}
+		err = storePending(db, pending, results)
+		pending = pending[:0]
+		return err
+	})
+	if err == nil {
+		err = storePending(db, pending, results)
+	}
+
+	if err == errUnsupportedArchive {
+		err = contentError{http.StatusUnsupportedMediaType, "Archives must be zip, tar or tar.gz"}
+	}
+	if _, rejected := err.(contentError); rejected {
+		rejectContent(err, c, w, r)
+		return
+	} else if err != nil {
+		errorHandler(err, c, w, r)
+		return
+	}
+	response(
+		http.StatusOK,
+		struct {
+			Files []archiveResult `json:"files"`
+		}{results},
+		c, w, r,
+	)
+}
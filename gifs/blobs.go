@@ -0,0 +1,118 @@
+package gifs
+
+import (
+	"bytes"
+
+	"github.com/boltdb/bolt"
+)
+
+const blobsBucketName string = "giftd-blobs"
+const blobRefsBucketName string = "giftd-blob-refs"
+
+// Entries in the root bucket point at a shared blob with this prefix followed
+// by the content hash. Entries written before deduplication hold the GIF
+// itself, which always starts with "GIF".
+var blobPointerPrefix []byte = []byte("sha256:")
+
+func blobPointer(hash string) []byte {
+	return append(append([]byte{}, blobPointerPrefix...), hash...)
+}
+
+func blobHash(pointer []byte) ([]byte, bool) {
+	if !bytes.HasPrefix(pointer, blobPointerPrefix) {
+		return nil, false
+	}
+	return pointer[len(blobPointerPrefix):], true
+}
+
+// readBlob returns the content stored for uuid, or nil if there is none.
+func readBlob(tx *bolt.Tx, uuid []byte) []byte {
+	value := tx.Bucket([]byte(root)).Get(uuid)
+	hash, ok := blobHash(value)
+	if !ok {
+		return value
+	}
+	blobs := tx.Bucket([]byte(blobsBucketName))
+	if blobs == nil {
+		return nil
+	}
+	return blobs.Get(hash)
+}
+
+// blobReferences returns the uuids sharing the blob with the given hash.
+func blobReferences(tx *bolt.Tx, hash string) [][]byte {
+	refs := tx.Bucket([]byte(blobRefsBucketName))
+	if refs == nil || refs.Bucket([]byte(hash)) == nil {
+		return nil
+	}
+	uuids := [][]byte{}
+	refs.Bucket([]byte(hash)).ForEach(func(uuid, _ []byte) error {
+		uuids = append(uuids, append([]byte{}, uuid...))
+		return nil
+	})
+	return uuids
+}
+
+// attachBlob points uuid at the shared blob for content, storing the blob if
+// this is the first reference to it.
+func attachBlob(tx *bolt.Tx, uuid, content []byte) error {
+	hash := contentHash(content)
+	blobs, err := tx.CreateBucketIfNotExists([]byte(blobsBucketName))
+	if err != nil {
+		return err
+	}
+	refs, err := tx.CreateBucketIfNotExists([]byte(blobRefsBucketName))
+	if err != nil {
+		return err
+	}
+	refsForBlob, err := refs.CreateBucketIfNotExists([]byte(hash))
+	if err != nil {
+		return err
+	}
+	if blobs.Get([]byte(hash)) == nil {
+		if err = blobs.Put([]byte(hash), content); err != nil {
+			return err
+		}
+	}
+	if err = refsForBlob.Put(uuid, []byte{}); err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(root)).Put(uuid, blobPointer(hash))
+}
+
+// detachBlob removes uuid from the root bucket and frees the blob it pointed
+// at once nothing else references it.
+func detachBlob(tx *bolt.Tx, uuid []byte) error {
+	rootBucket := tx.Bucket([]byte(root))
+	value := rootBucket.Get(uuid)
+	hash, ok := blobHash(value)
+	if ok {
+		hash = append([]byte{}, hash...)
+	} else if value != nil {
+		hash = []byte(contentHash(value))
+	}
+	if err := rootBucket.Delete(uuid); err != nil {
+		return err
+	} else if !ok {
+		return deleteDerivatives(tx, hash)
+	}
+
+	refs := tx.Bucket([]byte(blobRefsBucketName))
+	if refs == nil || refs.Bucket(hash) == nil {
+		return nil
+	}
+	refsForBlob := refs.Bucket(hash)
+	if err := refsForBlob.Delete(uuid); err != nil {
+		return err
+	}
+	if k, _ := refsForBlob.Cursor().First(); k != nil {
+		return nil
+	}
+	if err := refs.DeleteBucket(hash); err != nil {
+		return err
+	}
+	if err := deleteDerivatives(tx, hash); err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(blobsBucketName)).Delete(hash)
+}
@@ -0,0 +1,33 @@
+package gifs
+
+import (
+	"bytes"
+	"sync"
+)
+
+// Buffers larger than this are left for the garbage collector rather than
+// pinning the memory of an unusually large GIF inside the pool.
+const maxPooledBuffer int = 16 << 20
+
+// Values returned by bolt are only valid until their transaction closes, so
+// content that outlives the transaction is copied into a pooled buffer
+// instead of being served straight out of the memory map. Holding the read
+// transaction open while a slow client downloads would block bolt from
+// remapping the file as it grows.
+var contentBuffers sync.Pool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+func borrowBuffer() *bytes.Buffer {
+	buf := contentBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func returnBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBuffer {
+		contentBuffers.Put(buf)
+	}
+}
@@ -0,0 +1,60 @@
+package gifs
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A uuid's content can be replaced, quarantined or deleted, so served GIFs
+// are only cached for gif-max-age-seconds before clients must revalidate.
+// Revalidating is cheap as unchanged content is answered with a 304.
+const defaultGifMaxAgeSeconds int = 300
+
+func etagFor(hash []byte, rr resizeRequest) string {
+	if rr.requested() {
+		return fmt.Sprintf(`"%s-%dx%d-%s"`, hash, rr.Width, rr.Height, rr.Fit)
+	}
+	return fmt.Sprintf(`"%s"`, hash)
+}
+
+// notModified reports whether the conditional headers on r show the client
+// already holds the current representation.
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if match := r.Header.Get("If-None-Match"); len(match) > 0 {
+		for _, candidate := range strings.Split(match, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+		return false
+	}
+	if since := r.Header.Get("If-Modified-Since"); len(since) > 0 && !modified.IsZero() {
+		t, err := http.ParseTime(since)
+		return err == nil && !modified.Truncate(time.Second).After(t)
+	}
+	return false
+}
+
+func setCacheHeaders(w http.ResponseWriter, etag string, modified time.Time, maxAge int) {
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d, must-revalidate", maxAge))
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+}
+
+// writeContent serves content through http.ServeContent, which takes care of
+// HEAD, Range and If-Range requests, answering with 206 Partial Content (as
+// multipart/byteranges for several ranges) when only part is wanted.
+func writeContent(w http.ResponseWriter, r *http.Request, content []byte, modified time.Time) {
+	w.Header().Set("Content-Type", http.DetectContentType(content))
+	http.ServeContent(w, r, "", modified, bytes.NewReader(content))
+}
+
+func noStore(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", "no-store")
+}
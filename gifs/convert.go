@@ -0,0 +1,70 @@
+package gifs
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"strconv"
+
+	"golang.org/x/image/webp"
+)
+
+const formatGif string = "gif"
+const formatPng string = "png"
+const formatJpeg string = "jpeg"
+const formatWebp string = "webp"
+
+var errUnsupportedFormat error = errors.New("unsupported image format")
+
+var decoders map[string]func(io.Reader) (image.Image, error) = map[string]func(io.Reader) (image.Image, error){
+	"image/png":  png.Decode,
+	"image/jpeg": jpeg.Decode,
+	"image/webp": webp.Decode,
+}
+
+var formats map[string]string = map[string]string{
+	"image/gif":  formatGif,
+	"image/png":  formatPng,
+	"image/jpeg": formatJpeg,
+	"image/webp": formatWebp,
+}
+
+func keepOriginal(r *http.Request) bool {
+	keep, _ := strconv.ParseBool(r.URL.Query().Get("keep-original"))
+	return keep
+}
+
+// convertToGif sniffs the format of content and, unless keep is set,
+// re-encodes static PNG, JPEG and WebP images as a GIF. It returns the bytes
+// to store along with the format that was uploaded.
+func convertToGif(content []byte, keep bool) ([]byte, string, error) {
+	contentType := http.DetectContentType(content)
+	format, ok := formats[contentType]
+	if !ok {
+		return nil, "", errUnsupportedFormat
+	} else if format == formatGif {
+		return content, format, nil
+	}
+
+	img, err := decoders[contentType](bytes.NewReader(content))
+	if err != nil {
+		return nil, format, err
+	} else if keep {
+		return content, format, nil
+	}
+
+	var buff bytes.Buffer
+	if err = gif.Encode(&buff, img, &gif.Options{NumColors: 256}); err != nil {
+		return nil, format, err
+	}
+	return buff.Bytes(), format, nil
+}
+
+func isGif(content []byte) bool {
+	return http.DetectContentType(content) == "image/gif"
+}
@@ -0,0 +1,146 @@
+package gifs
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/csaunders/giftd/middleware"
+	"github.com/csaunders/giftd/models"
+	"github.com/zenazn/goji/web"
+)
+
+const dailyBucketName string = "giftd-daily"
+const dailyDateFormat string = "2006-01-02"
+
+// dailyPick records the GIF chosen for a namespace on a given day. Only the
+// latest pick is kept per namespace.
+type dailyPick struct {
+	Day  string `json:"day"`
+	UUID string `json:"uuid"`
+}
+
+// randomSource returns the source used to pick GIFs from namespace. Picks
+// with the same seed are reproducible for as long as the namespace is
+// unchanged; without one every pick is independent.
+func randomSource(namespace, seed string) *rand.Rand {
+	if len(seed) <= 0 {
+		return rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	h := fnv.New64a()
+	h.Write([]byte(namespace))
+	h.Write([]byte{0})
+	h.Write([]byte(seed))
+	return rand.New(rand.NewSource(int64(h.Sum64())))
+}
+
+// dailyWindow returns the day the current daily pick belongs to and when it
+// rolls over, honouring the configured timezone and rollover hour.
+func dailyWindow(c web.C, now time.Time) (string, time.Time) {
+	location := time.UTC
+	if name, ok := c.Env["daily-timezone"].(string); ok {
+		if loaded, err := time.LoadLocation(name); err == nil {
+			location = loaded
+		} else {
+			log.Println("dailyWindow:", err)
+		}
+	}
+	hour := intSetting(c, "daily-rollover-hour", 0) % 24
+	shifted := now.In(location).Add(-time.Duration(hour) * time.Hour)
+	next := time.Date(shifted.Year(), shifted.Month(), shifted.Day()+1, hour, 0, 0, 0, location)
+	return shifted.Format(dailyDateFormat), next
+}
+
+func loadDailyPick(tx *bolt.Tx, namespace []byte, day string) string {
+	daily := tx.Bucket([]byte(dailyBucketName))
+	if daily == nil {
+		return ""
+	}
+	var pick dailyPick
+	if err := json.Unmarshal(daily.Get(namespace), &pick); err != nil {
+		return ""
+	}
+	if pick.Day != day || !inNamespace(tx, namespace, []byte(pick.UUID)) {
+		return ""
+	}
+	return pick.UUID
+}
+
+// findDailyGif returns the GIF of the day for namespace, picking and storing
+// one if today has none yet or the stored pick has since been removed.
+func findDailyGif(db *bolt.DB, c web.C, namespace []byte, day string) (string, error) {
+	var uuid string
+	db.View(func(tx *bolt.Tx) error {
+		uuid = loadDailyPick(tx, namespace, day)
+		return nil
+	})
+	if len(uuid) > 0 {
+		return uuid, nil
+	}
+
+	strategy := defaultStrategy(db, c, string(namespace))
+	q := randomQuery{
+		Strategy: strategy,
+		Weights:  weightSettings(c),
+		Weigh:    weigherFor(c, strategy),
+		Rand:     randomSource(string(namespace), day),
+	}
+	uuids, err := q.pick(db, namespace, 1)
+	if err != nil || len(uuids) <= 0 {
+		return "", err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if existing := loadDailyPick(tx, namespace, day); len(existing) > 0 {
+			uuid = existing
+			return nil
+		}
+		uuid = uuids[0]
+		daily, err := tx.CreateBucketIfNotExists([]byte(dailyBucketName))
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(dailyPick{day, uuid})
+		if err != nil {
+			return err
+		}
+		return daily.Put(namespace, data)
+	})
+	return uuid, err
+}
+
+func dailyGif(db *bolt.DB, c web.C, w http.ResponseWriter, r *http.Request) {
+	namespace := c.URLParams["namespace"]
+	if !readable(namespace, c, w, r) {
+		return
+	}
+	account, _ := c.Env[middleware.AccountDetails].(models.Account)
+	now := time.Now()
+	day, rollover := dailyWindow(c, now)
+
+	var exists bool
+	db.View(func(tx *bolt.Tx) error {
+		exists = tx.Bucket([]byte(root)).Bucket([]byte(namespace)) != nil
+		return nil
+	})
+	if !exists {
+		notFound(fmt.Sprintf("%s has no gifs", namespace), c, w, r)
+		return
+	}
+
+	uuid, err := findDailyGif(db, c, []byte(namespace), day)
+	if err != nil {
+		errorHandler(err, c, w, r)
+		return
+	} else if len(uuid) <= 0 {
+		notFound(fmt.Sprintf("%s has no gifs", namespace), c, w, r)
+		return
+	}
+	countPicks(c, db, namespace, []string{uuid})
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(rollover.Sub(now).Seconds())))
+	http.Redirect(w, r, fmt.Sprintf("/gifs/%s/%s", account.Id, uuid), http.StatusTemporaryRedirect)
+}
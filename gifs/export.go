@@ -0,0 +1,191 @@
+package gifs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/csaunders/giftd/models"
+	"github.com/zenazn/goji/web"
+)
+
+const manifestName string = "manifest.json"
+const manifestVersion int = 1
+
+// manifest describes the contents of an export so that the archive can be
+// imported again with its titles, tags and namespaces intact.
+type manifest struct {
+	Version    int             `json:"version"`
+	ExportedAt time.Time       `json:"exported-at"`
+	Gifs       []manifestEntry `json:"gifs"`
+}
+
+type manifestEntry struct {
+	File      string   `json:"file"`
+	UUID      string   `json:"uuid"`
+	Namespace string   `json:"namespace"`
+	Metadata  Metadata `json:"metadata"`
+}
+
+type archiveWriter interface {
+	add(name string, modified time.Time, content []byte) error
+	Close() error
+}
+
+type zipArchive struct {
+	*zip.Writer
+}
+
+func (z zipArchive) add(name string, modified time.Time, content []byte) error {
+	header := &zip.FileHeader{Name: name, Method: zip.Store}
+	header.Modified = modified
+	entry, err := z.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = entry.Write(content)
+	return err
+}
+
+type tarArchive struct {
+	*tar.Writer
+}
+
+func (t tarArchive) add(name string, modified time.Time, content []byte) error {
+	header := &tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(content)),
+		ModTime:  modified,
+		Typeflag: tar.TypeReg,
+	}
+	if err := t.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := t.Write(content)
+	return err
+}
+
+func newArchiveWriter(format string, w io.Writer) archiveWriter {
+	if format == "tar" {
+		return tarArchive{tar.NewWriter(w)}
+	}
+	return zipArchive{zip.NewWriter(w)}
+}
+
+func exportExtension(content []byte) string {
+	if format, ok := formats[http.DetectContentType(content)]; ok {
+		return format
+	}
+	return formatGif
+}
+
+// exportNamespace writes every GIF in ns to archive straight out of the read
+// transaction, recording each one in m.
+func exportNamespace(tx *bolt.Tx, ns []byte, archive archiveWriter, m *manifest) error {
+	bucketForNamespace := tx.Bucket([]byte(root)).Bucket(ns)
+	if bucketForNamespace == nil {
+		return nil
+	}
+	cursor := bucketForNamespace.Cursor()
+	for uuid, data := cursor.First(); uuid != nil; uuid, data = cursor.Next() {
+		content := readBlob(tx, uuid)
+		if content == nil {
+			continue
+		}
+		entry := manifestEntry{UUID: string(uuid), Namespace: string(ns)}
+		if err := json.Unmarshal(data, &entry.Metadata); err != nil {
+			return err
+		}
+		entry.Metadata.Namespace = string(ns)
+		entry.File = fmt.Sprintf("%s/%s.%s", ns, uuid, exportExtension(content))
+		if err := archive.add(entry.File, entry.Metadata.UploadedAt, content); err != nil {
+			return err
+		}
+		m.Gifs = append(m.Gifs, entry)
+	}
+	return nil
+}
+
+func writeExport(db *bolt.DB, namespaces [][]byte, archive archiveWriter) error {
+	m := manifest{Version: manifestVersion, ExportedAt: time.Now().UTC(), Gifs: []manifestEntry{}}
+	err := db.View(func(tx *bolt.Tx) error {
+		if namespaces == nil {
+			namespaces = [][]byte{}
+			if b := tx.Bucket([]byte(root)).Bucket([]byte(namespacesBucketName)); b != nil {
+				b.ForEach(func(ns, _ []byte) error {
+					namespaces = append(namespaces, ns)
+					return nil
+				})
+			}
+		}
+		for _, ns := range namespaces {
+			if err := exportNamespace(tx, ns, archive, &m); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = archive.add(manifestName, m.ExportedAt, data); err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+func exportGifs(db *bolt.DB, c web.C, w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "zip"
+	} else if format != "zip" && format != "tar" {
+		response(http.StatusNotAcceptable, requestError{"format must be zip or tar"}, c, w, r)
+		return
+	}
+
+	namespace, scoped := c.URLParams["namespace"]
+	if !scoped {
+		namespace = models.AnyNamespace
+	}
+	if !authorized(models.ReadAccess, namespace, c, w, r) {
+		return
+	}
+
+	var namespaces [][]byte
+	filename := "giftd"
+	if scoped {
+		exists := false
+		db.View(func(tx *bolt.Tx) error {
+			exists = tx.Bucket([]byte(root)).Bucket([]byte(namespace)) != nil
+			return nil
+		})
+		if !exists {
+			notFound(fmt.Sprintf("%s does not exist", namespace), c, w, r)
+			return
+		}
+		namespaces = [][]byte{[]byte(namespace)}
+		filename = namespace
+	}
+
+	if format == "tar" {
+		w.Header().Set("Content-Type", "application/x-tar")
+	} else {
+		w.Header().Set("Content-Type", "application/zip")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename+"."+format))
+	w.WriteHeader(http.StatusOK)
+	if err := writeExport(db, namespaces, newArchiveWriter(format, w)); err != nil {
+		log.Println("exportGifs:", err)
+	}
+}
@@ -0,0 +1,182 @@
+package gifs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/zenazn/goji/web"
+)
+
+const userAgent string = "giftd (+https://github.com/csaunders/giftd)"
+const maxLinkLength int64 = 2048
+const defaultConnectTimeout int = 5
+const defaultFetchTimeout int = 30
+const defaultMaxRedirects int = 3
+
+// defaultDeniedNetworks keeps link imports away from loopback, private,
+// link-local (including cloud metadata endpoints) and other internal ranges.
+var defaultDeniedNetworks []string = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+var errDeniedAddress error = errors.New("address is not permitted")
+
+// fetcher retrieves remote GIFs for link imports.
+type fetcher struct {
+	client   *http.Client
+	maxBytes int64
+	denied   []*net.IPNet
+}
+
+func stringsSetting(c web.C, key string, fallback []string) []string {
+	values, ok := c.Env[key].([]interface{})
+	if !ok {
+		return fallback
+	}
+	strs := []string{}
+	for _, value := range values {
+		if s, ok := value.(string); ok {
+			strs = append(strs, s)
+		}
+	}
+	return strs
+}
+
+func parseNetworks(cidrs []string) []*net.IPNet {
+	networks := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		if _, network, err := net.ParseCIDR(cidr); err == nil {
+			networks = append(networks, network)
+		}
+	}
+	return networks
+}
+
+func fetcherFor(c web.C, bounds limits) *fetcher {
+	f := &fetcher{
+		maxBytes: int64(intSetting(c, "fetch-max-bytes", int(bounds.MaxBytes))),
+		denied:   parseNetworks(stringsSetting(c, "fetch-denied-networks", defaultDeniedNetworks)),
+	}
+	maxRedirects := intSetting(c, "fetch-max-redirects", defaultMaxRedirects)
+	dialer := &net.Dialer{
+		Timeout: time.Duration(intSetting(c, "fetch-connect-timeout", defaultConnectTimeout)) * time.Second,
+		Control: f.control,
+	}
+	f.client = &http.Client{
+		Timeout: time.Duration(intSetting(c, "fetch-timeout", defaultFetchTimeout)) * time.Second,
+		Transport: &http.Transport{
+			Proxy:             nil,
+			DialContext:       dialer.DialContext,
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			return checkScheme(req.URL)
+		},
+	}
+	return f
+}
+
+func checkScheme(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	return nil
+}
+
+// control runs once the address has been resolved, so it sees the IP that
+// is actually being connected to regardless of DNS tricks or redirects.
+func (f *fetcher) control(network, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return errDeniedAddress
+	}
+	for _, denied := range f.denied {
+		if denied.Contains(ip) {
+			return errDeniedAddress
+		}
+	}
+	return nil
+}
+
+func deniedAddress(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	if opErr, ok := err.(*net.OpError); ok {
+		err = opErr.Err
+	}
+	return err == errDeniedAddress
+}
+
+// readLink reads and validates the link submitted in a request body.
+func readLink(r io.Reader) (string, error) {
+	src, err := ioutil.ReadAll(io.LimitReader(r, maxLinkLength))
+	if err != nil {
+		return "", err
+	}
+	link := strings.TrimSpace(string(src))
+	u, err := url.Parse(link)
+	if err == nil {
+		err = checkScheme(u)
+	}
+	if err != nil {
+		return link, contentError{http.StatusNotAcceptable, "Links must be absolute http or https URLs"}
+	}
+	return link, nil
+}
+
+// fetch returns the body of the resource at link, which the caller must
+// close.
+func (f *fetcher) fetch(link string) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", link, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Accept", "image/*")
+	resp, err := f.client.Do(req)
+	if deniedAddress(err) {
+		return nil, contentError{http.StatusForbidden, "Links may not point at internal addresses"}
+	} else if err != nil {
+		return nil, contentError{http.StatusBadGateway, fmt.Sprintf("Could not retrieve link: %s", err)}
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, contentError{http.StatusBadGateway, fmt.Sprintf("Link responded with %s", resp.Status)}
+	}
+	if resp.ContentLength > f.maxBytes {
+		resp.Body.Close()
+		return nil, tooLarge("Linked file exceeds the maximum size of %d bytes", f.maxBytes)
+	}
+	return resp.Body, nil
+}
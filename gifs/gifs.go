@@ -1,18 +1,17 @@
 package gifs
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"image/gif"
 	"io"
-	"io/ioutil"
-	"math"
+	"log"
 	"math/rand"
 	"net/http"
 	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/csaunders/giftd/middleware"
@@ -24,59 +23,183 @@ import (
 const root string = "giftd-gifs"
 const maxRandGif int = 10
 const namespacesBucketName string = "namespaces"
+const defaultPageSize int = 25
+const maxPageSize int = 100
+const sortByUUID string = "uuid"
+const sortByScore string = "score"
+
+// Fixed path segments registered ahead of :namespace, which namespaces may
+// therefore not be named after.
+const searchSegment string = "search"
+const jobsSegment string = "jobs"
+const exportSegment string = "export"
+const topSegment string = "top"
+
+var fixedSegments []string = []string{searchSegment, jobsSegment, exportSegment, topSegment, namespacesBucketName}
 
 type requestError struct {
 	Error string `json:"error"`
 }
 
-func verifyGif(r io.Reader) ([]byte, error) {
-	data, err := ioutil.ReadAll(r)
-	buff := bytes.NewBuffer(data)
-	_, err = gif.Decode(buff)
+type listedGif struct {
+	UUID string `json:"uuid"`
+	Metadata
+}
+
+func verifyGif(r io.Reader, keep bool, bounds limits) ([]byte, Metadata, error) {
+	data, err := bounds.read(r)
+	if err != nil {
+		return []byte{}, Metadata{}, err
+	}
+	if err = bounds.check(data); err != nil {
+		return []byte{}, Metadata{}, err
+	}
+	data, format, err := convertToGif(data, keep)
+	if err != nil {
+		return []byte{}, Metadata{}, err
+	}
+	meta, err := describeGif(data)
 	if err != nil {
-		return []byte{}, err
+		return []byte{}, Metadata{}, err
 	}
-	return data, err
+	meta.Source = sourceUpload
+	meta.Format = format
+	return data, meta, nil
 }
 
-func storeGif(db *bolt.DB, ns, uuid, content []byte) error {
-	return db.Update(func(tx *bolt.Tx) error {
-		rootBucket := tx.Bucket([]byte(root))
+// storeGif files content under uuid in the namespace ns. If the namespace
+// already holds identical content the existing uuid is returned instead and
+// nothing is written.
+func storeGif(db *bolt.DB, ns, uuid, content []byte, meta Metadata) (string, bool, error) {
+	var stored string
+	var created bool
+	err := db.Update(func(tx *bolt.Tx) error {
+		var err error
+		stored, created, err = storeGifTx(tx, ns, uuid, content, meta)
+		return err
+	})
+	return stored, created, err
+}
 
-		namespacesBucket, err := rootBucket.CreateBucketIfNotExists([]byte(namespacesBucketName))
-		if err != nil {
-			return err
+func storeGifTx(tx *bolt.Tx, ns, uuid, content []byte, meta Metadata) (string, bool, error) {
+	meta.Namespace = string(ns)
+	metadata, err := json.Marshal(meta)
+	if err != nil {
+		return "", false, err
+	}
+
+	rootBucket := tx.Bucket([]byte(root))
+	for _, existing := range blobReferences(tx, contentHash(content)) {
+		if inNamespace(tx, ns, existing) {
+			return string(existing), false, nil
 		}
+	}
 
-		bucketForNamespace, err := rootBucket.CreateBucketIfNotExists(ns)
-		if err != nil {
+	bucketForNamespace, err := rootBucket.CreateBucketIfNotExists(ns)
+	if err != nil {
+		return "", false, err
+	}
+	if err = attachBlob(tx, uuid, content); err != nil {
+		return "", false, err
+	}
+	if err = bucketForNamespace.Put(uuid, metadata); err != nil {
+		return "", false, err
+	}
+	if err = setLocation(tx, uuid, ns); err != nil {
+		return "", false, err
+	}
+	if err = addPosition(tx, ns, uuid); err != nil {
+		return "", false, err
+	}
+	if err = indexTags(tx, uuid, meta.Tags); err != nil {
+		return "", false, err
+	}
+	if err = registerNamespace(tx, ns); err != nil {
+		return "", false, err
+	}
+	return string(uuid), true, nil
+}
+
+func removeFromNamespace(tx *bolt.Tx, ns, uuid []byte) error {
+	rootBucket := tx.Bucket([]byte(root))
+	bucketForNamespace := rootBucket.Bucket(ns)
+	if err := bucketForNamespace.Delete(uuid); err != nil {
+		return err
+	}
+	if err := clearLocation(tx, uuid); err != nil {
+		return err
+	}
+	if err := removePosition(tx, ns, uuid); err != nil {
+		return err
+	}
+	if k, _ := bucketForNamespace.Cursor().First(); k != nil {
+		return nil
+	}
+	if err := rootBucket.DeleteBucket(ns); err != nil {
+		return err
+	}
+	if err := dropPositions(tx, ns); err != nil {
+		return err
+	}
+	if err := dropBags(tx, ns); err != nil {
+		return err
+	}
+	return rootBucket.Bucket([]byte(namespacesBucketName)).Delete(ns)
+}
+
+func destroyGif(tx *bolt.Tx, uuid []byte) error {
+	rootBucket := tx.Bucket([]byte(root))
+	if rootBucket == nil || rootBucket.Get(uuid) == nil {
+		return models.RecordNotFound
+	}
+	var meta Metadata
+	if isQuarantined(tx, uuid) {
+		quarantine := tx.Bucket([]byte(quarantineBucketName))
+		if err := models.Load(quarantine, string(uuid), &meta); err != nil {
 			return err
 		}
-		if err = rootBucket.Put(uuid, content); err != nil {
+		if err := quarantine.Delete(uuid); err != nil {
 			return err
 		}
-		if err = bucketForNamespace.Put(uuid, []byte("{}")); err != nil {
+		if err := pruneEmptiedNamespace(tx, []byte(meta.Namespace)); err != nil {
 			return err
 		}
-		if err = namespacesBucket.Put(ns, []byte("{}")); err != nil {
+	} else if ns := findNamespace(tx, uuid); ns != nil {
+		if err := json.Unmarshal(rootBucket.Bucket(ns).Get(uuid), &meta); err != nil {
 			return err
 		}
+		if err := removeFromNamespace(tx, ns, uuid); err != nil {
+			return err
+		}
+	}
+	if err := unindexTags(tx, uuid, meta.Tags); err != nil {
+		return err
+	}
+	if err := detachBlob(tx, uuid); err != nil {
+		return err
+	}
+	if err := clearVotes(tx, uuid); err != nil {
+		return err
+	}
+	return clearReports(tx, uuid)
+}
 
-		return nil
-	})
+func inNamespace(tx *bolt.Tx, ns, uuid []byte) bool {
+	bucketForNamespace := tx.Bucket([]byte(root)).Bucket(ns)
+	return bucketForNamespace != nil && bucketForNamespace.Get(uuid) != nil
 }
 
-func retrieveAndVerify(r io.Reader) ([]byte, error) {
-	src, err := ioutil.ReadAll(r)
-	if err != nil {
-		return []byte{}, err
-	}
-	resp, err := http.Get(string(src))
+func retrieveAndVerify(link string, keep bool, bounds limits, f *fetcher) ([]byte, Metadata, error) {
+	body, err := f.fetch(link)
 	if err != nil {
-		return []byte{}, err
+		return []byte{}, Metadata{}, err
 	}
-	defer resp.Body.Close()
-	return verifyGif(resp.Body)
+	defer body.Close()
+	bounds.MaxBytes = f.maxBytes
+	content, meta, err := verifyGif(body, keep, bounds)
+	meta.Source = sourceLink
+	meta.Url = link
+	return content, meta, err
 }
 
 func errorHandler(err error, c web.C, w http.ResponseWriter, r *http.Request) {
@@ -96,6 +219,30 @@ func notFound(msg string, c web.C, w http.ResponseWriter, r *http.Request) {
 	)
 }
 
+// allowed reports whether the caller has access to namespace, either through
+// gifs-api or admin or a namespaced permission such as gifs:read:reactions.
+func allowed(access, namespace string, c web.C) bool {
+	account, ok := c.Env[middleware.AccountDetails].(models.Account)
+	return ok && account.Allows("gifs", access, namespace)
+}
+
+func authorized(access, namespace string, c web.C, w http.ResponseWriter, r *http.Request) bool {
+	if allowed(access, namespace, c) {
+		return true
+	}
+	response(http.StatusUnauthorized, requestError{"Access Denied"}, c, w, r)
+	return false
+}
+
+// readable guards the public endpoints: anonymous callers may read any
+// namespace, but callers presenting a token are held to its permissions.
+func readable(namespace string, c web.C, w http.ResponseWriter, r *http.Request) bool {
+	if _, ok := c.Env[middleware.AccountDetails].(models.Account); !ok {
+		return true
+	}
+	return authorized(models.ReadAccess, namespace, c, w, r)
+}
+
 func response(code int, body interface{}, c web.C, w http.ResponseWriter, r *http.Request) {
 	content, err := json.Marshal(body)
 	if err != nil {
@@ -106,86 +253,89 @@ func response(code int, body interface{}, c web.C, w http.ResponseWriter, r *htt
 	w.Write(content)
 }
 
-func nRandomIndiciesFor(db *bolt.DB, namespace []byte, num int) []int {
-	var indices []int
+func intSetting(c web.C, key string, fallback int) int {
+	if value, ok := c.Env[key].(float64); ok && value > 0 {
+		return int(value)
+	}
+	return fallback
+}
+
+// nRandomIndiciesFor picks up to num distinct positions in [0, size).
+func nRandomIndiciesFor(rng *rand.Rand, size, num int) []int {
+	if num >= size {
+		return rng.Perm(size)
+	}
+	indices := make([]int, 0, num)
 	indexMap := map[int]bool{}
-	namespaceSize := 0
-	db.View(func(tx *bolt.Tx) error {
-		namespaceBucket := tx.Bucket([]byte(root)).Bucket(namespace)
-		if namespaceBucket != nil {
-			namespaceSize = namespaceBucket.Stats().KeyN
-		}
-		return nil
-	})
-	indices = make([]int, int(math.Min(float64(num), float64(namespaceSize))))
-	index := 0
-	retries := 0
-	for {
-		if retries > 100 || index >= len(indices) {
-			break
-		}
-		n := rand.Intn(namespaceSize)
+	for len(indices) < num {
+		n := rng.Intn(size)
 		if !indexMap[n] {
-			indices[index] = n
+			indices = append(indices, n)
 			indexMap[n] = true
-			index++
-			retries = 0
-		} else {
-			retries++
 		}
 	}
-	sort.Sort(sort.IntSlice(indices))
 	return indices
 }
 
-func findRandomGifs(db *bolt.DB, namespace []byte, num int) ([]string, error) {
-	indices := nRandomIndiciesFor(db, namespace, num)
-	uuids := make([]string, len(indices))
-
+func findRandomGifs(db *bolt.DB, namespace []byte, num int, rng *rand.Rand) ([]string, error) {
+	var uuids []string
+	indexed := true
 	err := db.View(func(tx *bolt.Tx) error {
-		rootBucket := tx.Bucket([]byte(root))
-		bucketForNamespace := rootBucket.Bucket(namespace)
-		if bucketForNamespace == nil {
+		if tx.Bucket([]byte(root)).Bucket(namespace) == nil {
 			return errors.New("findRandomGifs: bucket does not exist")
 		}
-		cursor := bucketForNamespace.Cursor()
-		index := 0
-		position := 0
-		for k, _ := cursor.First(); k != nil; k, _ = cursor.Next() {
-			if index >= len(indices) {
-				break
-			} else if indices[index] == position {
-				uuids[index] = string(k)
-				index++
-			}
-			position++
+		size := positionCount(tx, namespace)
+		if indexed = size >= 0; !indexed {
+			return nil
+		}
+		indices := nRandomIndiciesFor(rng, size, num)
+		uuids = make([]string, len(indices))
+		for i, position := range indices {
+			uuids[i] = string(gifAtPosition(tx, namespace, position))
 		}
 		return nil
 	})
+	if err == nil && !indexed {
+		if err = indexPositions(db, namespace); err == nil {
+			return findRandomGifs(db, namespace, num, rng)
+		}
+	}
 	return uuids, err
 }
 
 func listNamespaces(db *bolt.DB, c web.C, w http.ResponseWriter, r *http.Request) {
 	var body struct {
-		Categories []string `json:"categories"`
+		Categories []string        `json:"categories"`
+		Namespaces []NamespaceInfo `json:"namespaces"`
 	}
 	err := db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(root)).Bucket([]byte(namespacesBucketName))
 		if b == nil {
 			body.Categories = []string{}
+			body.Namespaces = []NamespaceInfo{}
 			return nil
 		}
 		stats := b.Stats()
+		env := c
 		c := b.Cursor()
 		results := make([]string, stats.KeyN)
+		infos := make([]NamespaceInfo, stats.KeyN)
 		i := 0
 
-		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if !allowed(models.ReadAccess, string(k), env) {
+				continue
+			}
 			results[i] = string(k)
+			if err := json.Unmarshal(v, &infos[i]); err != nil {
+				return err
+			}
+			infos[i].Name = string(k)
 			i++
 		}
 
-		body.Categories = results
+		body.Categories = results[:i]
+		body.Namespaces = infos[:i]
 		return nil
 	})
 
@@ -196,148 +346,566 @@ func listNamespaces(db *bolt.DB, c web.C, w http.ResponseWriter, r *http.Request
 	response(http.StatusOK, body, c, w, r)
 }
 
+func listGifs(db *bolt.DB, c web.C, w http.ResponseWriter, r *http.Request) {
+	namespace := c.URLParams["namespace"]
+	if !authorized(models.ReadAccess, namespace, c, w, r) {
+		return
+	}
+	after := r.URL.Query().Get("after")
+	limit := defaultPageSize
+	if param := r.URL.Query().Get("limit"); len(param) > 0 {
+		parsed, err := strconv.Atoi(param)
+		if err != nil || parsed <= 0 || parsed > maxPageSize {
+			response(
+				http.StatusNotAcceptable,
+				requestError{fmt.Sprintf("limit must be between 1 and %d", maxPageSize)},
+				c, w, r,
+			)
+			return
+		}
+		limit = parsed
+	}
+	sortKey := r.URL.Query().Get("sort")
+	if sortKey != "" && sortKey != sortByUUID && sortKey != sortByScore {
+		response(
+			http.StatusNotAcceptable,
+			requestError{fmt.Sprintf("sort must be %s or %s", sortByUUID, sortByScore)},
+			c, w, r,
+		)
+		return
+	}
+	var scoreAfter scoreCursor
+	if sortKey == sortByScore && len(after) > 0 {
+		var err error
+		if scoreAfter, err = parseScoreCursor(after); err != nil {
+			response(http.StatusNotAcceptable, requestError{err.Error()}, c, w, r)
+			return
+		}
+	}
+
+	var body struct {
+		Gifs  []listedGif `json:"gifs"`
+		Total int         `json:"total"`
+		Next  string      `json:"next,omitempty"`
+	}
+	err := db.View(func(tx *bolt.Tx) error {
+		bucketForNamespace := tx.Bucket([]byte(root)).Bucket([]byte(namespace))
+		if bucketForNamespace == nil {
+			return models.RecordNotFound
+		}
+		body.Total = bucketForNamespace.Stats().KeyN
+		body.Gifs = []listedGif{}
+		if sortKey == sortByScore {
+			var err error
+			body.Gifs, body.Next, err = listByScore(bucketForNamespace, namespace, scoreAfter, limit)
+			return err
+		}
+
+		cursor := bucketForNamespace.Cursor()
+		var k, v []byte
+		if len(after) > 0 {
+			if k, v = cursor.Seek([]byte(after)); k != nil && string(k) == after {
+				k, v = cursor.Next()
+			}
+		} else {
+			k, v = cursor.First()
+		}
+		for ; k != nil; k, v = cursor.Next() {
+			if len(body.Gifs) >= limit {
+				body.Next = body.Gifs[len(body.Gifs)-1].UUID
+				break
+			}
+			gif := listedGif{UUID: string(k)}
+			if err := json.Unmarshal(v, &gif.Metadata); err != nil {
+				return err
+			}
+			gif.Namespace = namespace
+			body.Gifs = append(body.Gifs, gif)
+		}
+		return nil
+	})
+
+	switch err {
+	case nil:
+		response(http.StatusOK, body, c, w, r)
+	case models.RecordNotFound:
+		notFound(fmt.Sprintf("%s does not exist", namespace), c, w, r)
+	default:
+		errorHandler(err, c, w, r)
+	}
+}
+
+// scoreCursor marks where a page sorted by score ended. It holds the score
+// as well as the uuid, so the next page can resume in the right place even
+// if that GIF has since been removed or its score has changed.
+type scoreCursor struct {
+	Score int
+	UUID  string
+}
+
+func parseScoreCursor(after string) (scoreCursor, error) {
+	parts := strings.SplitN(after, ":", 2)
+	if len(parts) == 2 && len(parts[1]) > 0 {
+		if score, err := strconv.Atoi(parts[0]); err == nil {
+			return scoreCursor{score, parts[1]}, nil
+		}
+	}
+	return scoreCursor{}, errors.New("after must be score:uuid when sorting by score")
+}
+
+func (cursor scoreCursor) String() string {
+	return fmt.Sprintf("%d:%s", cursor.Score, cursor.UUID)
+}
+
+// sortsBefore reports whether a GIF with score and uuid is listed before the
+// cursor's position, with higher scores first and ties in uuid order.
+func (cursor scoreCursor) sortsBefore(score int, uuid string) bool {
+	if score == cursor.Score {
+		return uuid <= cursor.UUID
+	}
+	return score > cursor.Score
+}
+
+// listByScore pages through a namespace from the highest scoring GIF down,
+// starting after cursor unless it is empty.
+func listByScore(bucketForNamespace *bolt.Bucket, namespace string, cursor scoreCursor, limit int) ([]listedGif, string, error) {
+	gifs := []listedGif{}
+	err := bucketForNamespace.ForEach(func(k, v []byte) error {
+		gif := listedGif{UUID: string(k)}
+		if err := json.Unmarshal(v, &gif.Metadata); err != nil {
+			return err
+		}
+		if len(cursor.UUID) > 0 && cursor.sortsBefore(gif.Score, gif.UUID) {
+			return nil
+		}
+		gif.Namespace = namespace
+		gifs = append(gifs, gif)
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	sort.Slice(gifs, func(i, j int) bool {
+		if gifs[i].Score == gifs[j].Score {
+			return gifs[i].UUID < gifs[j].UUID
+		}
+		return gifs[i].Score > gifs[j].Score
+	})
+	if len(gifs) > limit {
+		last := gifs[limit-1]
+		return gifs[:limit], scoreCursor{last.Score, last.UUID}.String(), nil
+	}
+	return gifs, "", nil
+}
+
 func showGif(db *bolt.DB, c web.C, w http.ResponseWriter, r *http.Request) {
 	uuid := c.URLParams["uuid"]
-	var content []byte
-	err := db.View(func(tx *bolt.Tx) error {
-		content = tx.Bucket([]byte(root)).Get([]byte(uuid))
+	resize, err := parseResize(c, r)
+	if err != nil {
+		response(http.StatusNotAcceptable, requestError{err.Error()}, c, w, r)
+		return
+	}
+	var content, hash []byte
+	var modified time.Time
+	var namespace string
+	var quarantined bool
+	buf := borrowBuffer()
+	defer returnBuffer(buf)
+	err = db.View(func(tx *bolt.Tx) error {
+		if quarantined = isQuarantined(tx, []byte(uuid)); quarantined {
+			return nil
+		}
+		buf.Write(readBlob(tx, []byte(uuid)))
+		content = buf.Bytes()
+		hash = derivativeKey(tx, []byte(uuid))
+		if meta, found, err := readMetadata(tx, []byte(uuid)); err == nil && found {
+			modified = meta.UploadedAt
+			namespace = meta.Namespace
+		}
 		return nil
 	})
 	if err != nil {
 		errorHandler(err, c, w, r)
 		return
+	} else if quarantined {
+		response(
+			http.StatusUnavailableForLegalReasons,
+			requestError{fmt.Sprintf("%s is awaiting moderation", uuid)},
+			c, w, r,
+		)
+		return
 	} else if len(content) <= 0 {
 		notFound(fmt.Sprintf("%s does not exist", uuid), c, w, r)
 		return
 	}
-	w.Header().Set("Content-Type", "image/gif")
-	w.Write(content)
+	if resize.requested() && !isGif(content) {
+		response(http.StatusNotAcceptable, requestError{"Only GIFs can be resized"}, c, w, r)
+		return
+	}
+
+	etag := etagFor(hash, resize)
+	setCacheHeaders(w, etag, modified, intSetting(c, "gif-max-age-seconds", defaultGifMaxAgeSeconds))
+	if notModified(r, etag, modified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if resize.requested() {
+		if content, err = ensureVariant(db, []byte(uuid), content, resize); err != nil {
+			errorHandler(err, c, w, r)
+			return
+		}
+	}
+	countView(c, db, r, namespace, uuid)
+	writeContent(w, r, content, modified)
+}
+
+// saveGif stores verified content uploaded by accountId, returning the uuid
+// it is reachable at and whether it was newly created.
+func saveGif(db *bolt.DB, c web.C, namespace, accountId string, tags []string, content []byte, meta Metadata) (string, bool, error) {
+	uuid, err := models.GenUUID()
+	if err != nil {
+		return "", false, err
+	}
+
+	meta.UploadedAt = time.Now().UTC()
+	meta.AccountId = accountId
+	meta.Tags = tags
+	stored, created, err := storeGif(db, []byte(namespace), []byte(uuid), content, meta)
+	if err != nil || !created {
+		return stored, created, err
+	}
+	if _, err = ensureThumbnail(db, []byte(stored), intSetting(c, "thumbnail-size", defaultThumbnailSize)); err != nil {
+		log.Println("saveGif: thumbnail:", err)
+	}
+	return stored, created, nil
 }
 
 func createGif(db *bolt.DB, c web.C, w http.ResponseWriter, r *http.Request) {
 	namespace := c.URLParams["namespace"]
+	if !authorized(models.WriteAccess, namespace, c, w, r) {
+		return
+	}
+	if !validNamespace(namespace) {
+		response(http.StatusNotAcceptable, requestError{invalidNamespaceMessage}, c, w, r)
+		return
+	}
+	account, _ := c.Env[middleware.AccountDetails].(models.Account)
 	var content []byte
+	var meta Metadata
 	var err error
 	switch c.URLParams["type"] {
 	case "gif":
-		content, err = verifyGif(r.Body)
+		content, meta, err = verifyGif(r.Body, keepOriginal(r), limitsFor(c))
 	case "link":
-		content, err = retrieveAndVerify(r.Body)
+		enqueueImport(db, c, w, r)
+		return
+	case "archive":
+		importArchive(db, c, w, r)
+		return
 	default:
 		response(
 			http.StatusNotAcceptable,
-			requestError{"Invalid or unspecified resource: use gif or link"},
+			requestError{"Invalid or unspecified resource: use gif, link or archive"},
 			c, w, r,
 		)
 		return
 	}
 
 	if err != nil {
-		response(
-			http.StatusUnsupportedMediaType,
-			requestError{"Invalid Content"},
-			c, w, r,
-		)
+		rejectContent(err, c, w, r)
 		return
 	}
 
-	uuid, err := models.GenUUID()
+	stored, created, err := saveGif(db, c, namespace, account.Id, parseTags(r.URL.Query().Get("tags")), content, meta)
 	if err != nil {
 		errorHandler(err, c, w, r)
 		return
 	}
+	code := http.StatusCreated
+	if !created {
+		code = http.StatusOK
+	}
+	response(
+		code, struct {
+			UUID string `json:"uuid"`
+		}{stored},
+		c, w, r,
+	)
+}
+
+func replaceGif(db *bolt.DB, c web.C, w http.ResponseWriter, r *http.Request) {
+	namespace := c.URLParams["namespace"]
+	uuid := c.URLParams["uuid"]
+	if !authorized(models.WriteAccess, namespace, c, w, r) {
+		return
+	}
+	account, _ := c.Env[middleware.AccountDetails].(models.Account)
 
-	err = storeGif(db, []byte(namespace), []byte(uuid), content)
+	content, meta, err := verifyGif(r.Body, keepOriginal(r), limitsFor(c))
 	if err != nil {
-		errorHandler(err, c, w, r)
-	} else {
+		rejectContent(err, c, w, r)
+		return
+	}
+	meta.Namespace = namespace
+	meta.UploadedAt = time.Now().UTC()
+	meta.AccountId = account.Id
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if !inNamespace(tx, []byte(namespace), []byte(uuid)) {
+			return models.RecordNotFound
+		}
+		previous, _, err := readMetadata(tx, []byte(uuid))
+		if err != nil {
+			return err
+		}
+		meta.Tags = previous.Tags
+		meta.Weight = previous.Weight
+		meta.Score = previous.Score
+		if raw := r.URL.Query().Get("tags"); len(raw) > 0 {
+			if err = unindexTags(tx, []byte(uuid), previous.Tags); err != nil {
+				return err
+			}
+			meta.Tags = parseTags(raw)
+			if err = indexTags(tx, []byte(uuid), meta.Tags); err != nil {
+				return err
+			}
+		}
+		if err := detachBlob(tx, []byte(uuid)); err != nil {
+			return err
+		}
+		if err := attachBlob(tx, []byte(uuid), content); err != nil {
+			return err
+		}
+		return writeMetadata(tx, []byte(uuid), meta)
+	})
+	if err == nil {
+		if _, err = ensureThumbnail(db, []byte(uuid), intSetting(c, "thumbnail-size", defaultThumbnailSize)); err != nil {
+			log.Println("replaceGif: thumbnail:", err)
+			err = nil
+		}
+	}
+	switch err {
+	case nil:
 		response(
-			http.StatusCreated, struct {
+			http.StatusOK, struct {
 				UUID string `json:"uuid"`
-			}{string(uuid)},
+			}{uuid},
 			c, w, r,
 		)
+	case models.RecordNotFound:
+		notFound(fmt.Sprintf("%s does not exist in %s", uuid, namespace), c, w, r)
+	default:
+		errorHandler(err, c, w, r)
 	}
 }
 
-func randomGif(db *bolt.DB, c web.C, w http.ResponseWriter, r *http.Request) {
+func deleteGif(db *bolt.DB, c web.C, w http.ResponseWriter, r *http.Request) {
 	namespace := c.URLParams["namespace"]
+	uuid := c.URLParams["uuid"]
+	if !authorized(models.WriteAccess, namespace, c, w, r) {
+		return
+	}
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		if !inNamespace(tx, []byte(namespace), []byte(uuid)) {
+			return models.RecordNotFound
+		}
+		return destroyGif(tx, []byte(uuid))
+	})
+	switch err {
+	case nil:
+		response(http.StatusOK, struct{}{}, c, w, r)
+	case models.RecordNotFound:
+		notFound(fmt.Sprintf("%s does not exist in %s", uuid, namespace), c, w, r)
+	default:
+		errorHandler(err, c, w, r)
+	}
+}
+
+func locationsFor(c web.C, uuids []string) []string {
 	account, _ := c.Env[middleware.AccountDetails].(models.Account)
-	uuids, err := findRandomGifs(db, []byte(namespace), 1)
+	host, ok := c.Env["host"].(string)
+	if !ok {
+		host = "localhost:8000"
+	}
+	paths := make([]string, len(uuids))
+	for i, uuid := range uuids {
+		paths[i] = fmt.Sprintf("http://%s/gifs/%s/%s", host, account.Id, uuid)
+	}
+	return paths
+}
 
+// randomQuery describes how GIFs should be picked from a namespace.
+type randomQuery struct {
+	Strategy string
+	Weights  weightParams
+	Weigh    weigher
+	Tags     []string
+	Mode     string
+	Rand     *rand.Rand
+}
+
+func parseRandomQuery(db *bolt.DB, c web.C, r *http.Request, namespace string) (randomQuery, error) {
+	strategy, err := randomStrategy(db, c, r, namespace)
+	if err != nil {
+		return randomQuery{}, err
+	}
+	mode, err := matchMode(r)
 	if err != nil {
+		return randomQuery{}, contentError{http.StatusNotAcceptable, err.Error()}
+	}
+	return randomQuery{
+		Strategy: strategy,
+		Weights:  weightSettings(c),
+		Weigh:    weigherFor(c, strategy),
+		Tags:     parseTags(r.URL.Query().Get("tags")),
+		Mode:     mode,
+		Rand:     randomSource(namespace, r.URL.Query().Get("seed")),
+	}, nil
+}
+
+func (q randomQuery) pick(db *bolt.DB, namespace []byte, num int) ([]string, error) {
+	if len(q.Tags) <= 0 {
+		if q.Weigh != nil {
+			return findIndexedWeightedGifs(db, namespace, num, q.Strategy, q.Weights, q.Rand)
+		}
+		return findRandomGifs(db, namespace, num, q.Rand)
+	}
+	if q.Weigh != nil {
+		var candidates []string
+		db.View(func(tx *bolt.Tx) error {
+			candidates = taggedGifs(tx, q.Tags, q.Mode)
+			return nil
+		})
+		return findWeightedGifs(db, namespace, num, candidates, q.Weigh, q.Rand)
+	}
+	return findRandomTaggedGifs(db, namespace, num, q.Tags, q.Mode, q.Rand)
+}
+
+func pickRandomGifs(db *bolt.DB, c web.C, namespace []byte, num int, r *http.Request) ([]string, error) {
+	q, err := parseRandomQuery(db, c, r, string(namespace))
+	if err != nil {
+		return []string{}, err
+	}
+	if shuffleRequested(r) {
+		ttl := time.Duration(intSetting(c, "shuffle-bag-ttl-hours", defaultBagTTLHours)) * time.Hour
+		uuids, err := q.pickFromBag(db, namespace, num, clientIdentity(c, r), ttl)
+		if err == models.RecordNotFound {
+			return []string{}, nil
+		}
+		return uuids, err
+	}
+	return q.pick(db, namespace, num)
+}
+
+func randomGif(db *bolt.DB, c web.C, w http.ResponseWriter, r *http.Request) {
+	namespace := c.URLParams["namespace"]
+	if !readable(namespace, c, w, r) {
+		return
+	}
+	account, _ := c.Env[middleware.AccountDetails].(models.Account)
+	uuids, err := pickRandomGifs(db, c, []byte(namespace), 1, r)
+
+	if _, rejected := err.(contentError); rejected {
+		rejectContent(err, c, w, r)
+		return
+	} else if err != nil {
 		errorHandler(err, c, w, r)
 		return
+	} else if len(uuids) <= 0 {
+		notFound(fmt.Sprintf("%s has no gifs", namespace), c, w, r)
+		return
 	}
+	countPicks(c, db, namespace, uuids)
+	noStore(w)
 	http.Redirect(w, r, fmt.Sprintf("/gifs/%s/%s", account.Id, string(uuids[0])), http.StatusTemporaryRedirect)
 }
 
 func randomNumGifs(db *bolt.DB, c web.C, w http.ResponseWriter, r *http.Request) {
 	namespace := c.URLParams["namespace"]
-	account, _ := c.Env[middleware.AccountDetails].(models.Account)
+	if !readable(namespace, c, w, r) {
+		return
+	}
 	count, err := strconv.ParseInt(c.URLParams["count"], 10, 64)
 	if err != nil {
 		errorHandler(err, c, w, r)
 		return
 	}
 
-	if int(count) > maxRandGif {
+	if count < 1 || int(count) > maxRandGif {
 		response(
 			http.StatusNotAcceptable,
-			requestError{fmt.Sprintf("Request exceeds maximum random gif count of %d", maxRandGif)},
+			requestError{fmt.Sprintf("Random gif count must be between 1 and %d", maxRandGif)},
 			c,
 			w,
 			r,
 		)
 		return
 	}
-	host, ok := c.Env["host"].(string)
-	if !ok {
-		host = "localhost:8000"
-	}
-	uuids, err := findRandomGifs(db, []byte(namespace), int(count))
-	paths := make([]string, len(uuids))
-	if err != nil {
+	uuids, err := pickRandomGifs(db, c, []byte(namespace), int(count), r)
+	if _, rejected := err.(contentError); rejected {
+		rejectContent(err, c, w, r)
+		return
+	} else if err != nil {
 		errorHandler(err, c, w, r)
 		return
 	}
-	for i, uuid := range uuids {
-		paths[i] = fmt.Sprintf("http://%s/gifs/%s/%s", host, account.Id, uuid)
-	}
+	countPicks(c, db, namespace, uuids)
+	noStore(w)
 	response(
 		http.StatusOK,
 		struct {
 			Locations []string `json:"locations"`
-		}{paths},
+		}{locationsFor(c, uuids)},
 		c,
 		w,
 		r,
 	)
 }
 
-func reportGif(db *bolt.DB, c web.C, w http.ResponseWriter, r *http.Request) {
-	response(http.StatusNotImplemented, requestError{"Not Implemented"}, c, w, r)
-}
-
 func createBucket(db *bolt.DB) error {
 	return db.Update(func(tx *bolt.Tx) error {
 		_, err := tx.CreateBucketIfNotExists([]byte(root))
 		if err != nil {
 			return fmt.Errorf("create bucket: %s", err)
 		}
-		return nil
+		if err = indexLocations(tx); err != nil {
+			return err
+		}
+		return backfillLegacyMetadata(tx)
 	})
 }
 
 func Register(root string, provider middleware.DatabaseProvider) {
 	goji.Get(fmt.Sprintf("%s", root), provider(createBucket, listNamespaces))
+	goji.Get(fmt.Sprintf("%s/%s", root, searchSegment), provider(createBucket, searchGifs))
+	goji.Get(fmt.Sprintf("%s/%s/:id", root, jobsSegment), provider(createBucket, showJob))
+	goji.Get(fmt.Sprintf("%s/%s", root, exportSegment), provider(createBucket, exportGifs))
+	goji.Get(fmt.Sprintf("%s/%s", root, topSegment), provider(createBucket, showTopGifs))
+	goji.Get(fmt.Sprintf("%s/%s/:namespace", root, namespacesBucketName), provider(createBucket, showNamespace))
+	goji.Put(fmt.Sprintf("%s/%s/:namespace", root, namespacesBucketName), provider(createBucket, updateNamespace))
+	goji.Post(fmt.Sprintf("%s/%s/:namespace/rename", root, namespacesBucketName), provider(createBucket, moveNamespace))
+	goji.Post(fmt.Sprintf("%s/%s/:namespace/merge", root, namespacesBucketName), provider(createBucket, moveNamespace))
+	goji.Delete(fmt.Sprintf("%s/%s/:namespace", root, namespacesBucketName), provider(createBucket, destroyNamespace))
+	goji.Get(fmt.Sprintf("%s/:namespace", root), provider(createBucket, listGifs))
 
 	// Creation / Retrieval
 	goji.Post(fmt.Sprintf("%s/:namespace/:type", root), provider(createBucket, createGif))
 	goji.Get(fmt.Sprintf("%s/:namespace/random", root), provider(createBucket, randomGif))
+	goji.Get(fmt.Sprintf("%s/:namespace/daily", root), provider(createBucket, dailyGif))
+	goji.Get(fmt.Sprintf("%s/:namespace/export", root), provider(createBucket, exportGifs))
+	goji.Get(fmt.Sprintf("%s/:namespace/stats", root), provider(createBucket, showStats))
 	goji.Get(fmt.Sprintf("%s/:namespace/random/:count", root), provider(createBucket, randomNumGifs))
 
 	// Gif Specific
 	goji.Get(fmt.Sprintf("%s/:account_id/:uuid", root), provider(createBucket, showGif))
+	goji.Get(fmt.Sprintf("%s/:account_id/:uuid/info", root), provider(createBucket, showInfo))
+	goji.Get(fmt.Sprintf("%s/:account_id/:uuid/thumbnail", root), provider(createBucket, showThumbnail))
 	goji.Delete(fmt.Sprintf("%s/:account_id/:uuid/report", root), provider(createBucket, reportGif))
+	goji.Post(fmt.Sprintf("%s/:account_id/:uuid/vote", root), provider(createBucket, voteGif))
+
+	// Modification
+	goji.Put(fmt.Sprintf("%s/:namespace/:uuid", root), provider(createBucket, replaceGif))
+	goji.Put(fmt.Sprintf("%s/:namespace/:uuid/tags", root), provider(createBucket, updateTags))
+	goji.Delete(fmt.Sprintf("%s/:namespace/:uuid", root), provider(createBucket, deleteGif))
 }
@@ -0,0 +1,287 @@
+package gifs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/csaunders/giftd/middleware"
+	"github.com/csaunders/giftd/models"
+	"github.com/zenazn/goji/web"
+)
+
+func openTestDB(t *testing.T) *bolt.DB {
+	t.Helper()
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "giftd.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	db.NoSync = true
+	if err = createBucket(db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func testContext(params map[string]string, perms ...string) web.C {
+	return web.C{
+		URLParams: params,
+		Env: map[interface{}]interface{}{
+			middleware.AccountDetails: models.Account{Id: "account", Permissions: perms},
+		},
+	}
+}
+
+// noisyGif encodes a GIF of random pixels, which compresses poorly enough
+// to span several of bolt's pages.
+func noisyGif(t *testing.T, rng *rand.Rand, size int) []byte {
+	t.Helper()
+	frame := image.NewPaletted(image.Rect(0, 0, size, size), palette.Plan9)
+	rng.Read(frame.Pix)
+	var buf bytes.Buffer
+	if err := gif.Encode(&buf, frame, nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// slowClient stands in for a client on a slow connection. Content is copied
+// out only after the headers have been written, so stalling there serves it
+// well after the read transaction it came from has closed.
+type slowClient struct {
+	*httptest.ResponseRecorder
+}
+
+func (s slowClient) WriteHeader(code int) {
+	time.Sleep(2 * time.Millisecond)
+	s.ResponseRecorder.WriteHeader(code)
+}
+
+func serveGif(db *bolt.DB, uuid string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	showGif(db, testContext(map[string]string{"uuid": uuid}), slowClient{w}, httptest.NewRequest("GET", "/gifs/account/"+uuid, nil))
+	return w
+}
+
+func putGif(db *bolt.DB, namespace, uuid string, content []byte) *httptest.ResponseRecorder {
+	c := testContext(map[string]string{"namespace": namespace, "uuid": uuid}, "gifs-api")
+	w := httptest.NewRecorder()
+	replaceGif(db, c, w, httptest.NewRequest("PUT", "/gifs/"+namespace+"/"+uuid, bytes.NewReader(content)))
+	return w
+}
+
+// TestShowGifDuringWrites serves GIFs while they are being replaced and new
+// ones stored. Replacing content frees the pages it was read from for reuse,
+// so bytes served after their read transaction closed, or a pooled buffer
+// shared between two requests, would match none of the stored versions.
+func TestShowGifDuringWrites(t *testing.T) {
+	db := openTestDB(t)
+	const gifs, rounds = 2, 40
+	rng := rand.New(rand.NewSource(1))
+
+	versions := make([][][]byte, gifs)
+	for i := range versions {
+		for round := 0; round <= rounds; round++ {
+			versions[i] = append(versions[i], noisyGif(t, rng, 64+rng.Intn(32)))
+		}
+		uuid := fmt.Sprintf("gif-%d", i)
+		if _, _, err := storeGif(db, []byte("reactions"), []byte(uuid), versions[i][0], Metadata{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	added := make([][]byte, rounds)
+	for i := range added {
+		added[i] = noisyGif(t, rng, 48)
+	}
+	isVersionOf := func(i int, served []byte) bool {
+		for _, version := range versions[i] {
+			if bytes.Equal(served, version) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for round := 1; round <= rounds; round++ {
+			for i := range versions {
+				uuid := fmt.Sprintf("gif-%d", i)
+				if res := putGif(db, "reactions", uuid, versions[i][round]); res.Code != http.StatusOK {
+					t.Errorf("replace %s: status %d", uuid, res.Code)
+					return
+				}
+			}
+			uuid := fmt.Sprintf("added-%d", round)
+			if _, _, err := storeGif(db, []byte("reactions"), []byte(uuid), added[round-1], Metadata{}); err != nil {
+				t.Error(err)
+				return
+			}
+			if got := serveGif(db, uuid).Body.Bytes(); !bytes.Equal(got, added[round-1]) {
+				t.Errorf("%s: served %d bytes that differ from the %d stored", uuid, len(got), len(added[round-1]))
+			}
+		}
+	}()
+	for i := range versions {
+		for reader := 0; reader < 4; reader++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				uuid := fmt.Sprintf("gif-%d", i)
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					res := serveGif(db, uuid)
+					if res.Code != http.StatusOK {
+						t.Errorf("%s: status %d", uuid, res.Code)
+						return
+					}
+					if !isVersionOf(i, res.Body.Bytes()) {
+						t.Errorf("%s: served %d bytes matching none of the stored versions", uuid, res.Body.Len())
+						return
+					}
+				}
+			}(i)
+		}
+	}
+	wg.Wait()
+}
+
+func TestShowGifNotFound(t *testing.T) {
+	db := openTestDB(t)
+	if res := serveGif(db, "missing"); res.Code != http.StatusNotFound {
+		t.Errorf("status %d, want %d", res.Code, http.StatusNotFound)
+	}
+}
+
+func TestRandomNumGifsRejectsCount(t *testing.T) {
+	db := openTestDB(t)
+	for _, count := range []string{"-1", "0", "11"} {
+		c := testContext(map[string]string{"namespace": "reactions", "count": count}, "gifs:read:reactions")
+		w := httptest.NewRecorder()
+		randomNumGifs(db, c, w, httptest.NewRequest("GET", "/gifs/reactions/random/"+count, nil))
+		if w.Code != http.StatusNotAcceptable {
+			t.Errorf("count %s: status %d, want %d", count, w.Code, http.StatusNotAcceptable)
+		}
+	}
+}
+
+func TestCreateGifRejectsInvalidNamespace(t *testing.T) {
+	db := openTestDB(t)
+	content := encodeGif(t, 10, 10, 1)
+	for _, namespace := range append([]string{"Reactions", "foo.bar"}, fixedSegments...) {
+		c := testContext(map[string]string{"namespace": namespace, "type": "gif"}, "gifs-api")
+		w := httptest.NewRecorder()
+		createGif(db, c, w, httptest.NewRequest("POST", "/gifs/"+namespace+"/gif", bytes.NewReader(content)))
+		if w.Code != http.StatusNotAcceptable {
+			t.Errorf("%s: status %d, want %d", namespace, w.Code, http.StatusNotAcceptable)
+		}
+	}
+}
+
+func TestRandomEndpointsHonourScopedPermissions(t *testing.T) {
+	db := openTestDB(t)
+	if _, _, err := storeGif(db, []byte("cats"), []byte("gif-0"), encodeGif(t, 10, 10, 1), Metadata{}); err != nil {
+		t.Fatal(err)
+	}
+
+	handlers := map[string]func(*bolt.DB, web.C, http.ResponseWriter, *http.Request){
+		"random":   randomGif,
+		"random/1": randomNumGifs,
+		"daily":    dailyGif,
+	}
+	for path, handler := range handlers {
+		cases := []struct {
+			account bool
+			perms   []string
+			served  bool
+		}{
+			{false, nil, true},
+			{true, []string{"gifs:read:cats"}, true},
+			{true, []string{"gifs:read:reactions"}, false},
+		}
+		for _, tc := range cases {
+			c := testContext(map[string]string{"namespace": "cats", "count": "1"}, tc.perms...)
+			if !tc.account {
+				delete(c.Env, middleware.AccountDetails)
+			}
+			w := httptest.NewRecorder()
+			handler(db, c, w, httptest.NewRequest("GET", "/gifs/cats/"+path, nil))
+			if tc.served && w.Code != http.StatusOK && w.Code != http.StatusTemporaryRedirect {
+				t.Errorf("%s with %v: status %d, want a GIF", path, tc.perms, w.Code)
+			} else if !tc.served && w.Code != http.StatusUnauthorized {
+				t.Errorf("%s with %v: status %d, want %d", path, tc.perms, w.Code, http.StatusUnauthorized)
+			}
+		}
+	}
+}
+
+func TestListByScoreResumesAfterRemovedGif(t *testing.T) {
+	db := openTestDB(t)
+	ns := []byte("reactions")
+	scores := map[string]int{"a": 3, "b": 2, "c": 2, "d": 1, "e": 0}
+	i := 0
+	for uuid, score := range scores {
+		if _, _, err := storeGif(db, ns, []byte(uuid), encodeGif(t, 10+i, 10, 1), Metadata{Score: score}); err != nil {
+			t.Fatal(err)
+		}
+		i++
+	}
+	list := func(after string) (uuids []string, next string) {
+		t.Helper()
+		c := testContext(map[string]string{"namespace": "reactions"}, "gifs:read:reactions")
+		w := httptest.NewRecorder()
+		listGifs(db, c, w, httptest.NewRequest("GET", "/gifs/reactions?sort=score&limit=2&after="+after, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("after %q: status %d", after, w.Code)
+		}
+		var body struct {
+			Gifs []listedGif `json:"gifs"`
+			Next string      `json:"next"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		for _, gif := range body.Gifs {
+			uuids = append(uuids, gif.UUID)
+		}
+		return uuids, body.Next
+	}
+
+	first, next := list("")
+	if fmt.Sprint(first) != "[a b]" || next != "2:b" {
+		t.Fatalf("first page %v, next %q; want [a b], 2:b", first, next)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error { return destroyGif(tx, []byte("b")) }); err != nil {
+		t.Fatal(err)
+	}
+	if second, _ := list(next); fmt.Sprint(second) != "[c d]" {
+		t.Errorf("page after removed b = %v, want [c d]", second)
+	}
+
+	c := testContext(map[string]string{"namespace": "reactions"}, "gifs:read:reactions")
+	w := httptest.NewRecorder()
+	listGifs(db, c, w, httptest.NewRequest("GET", "/gifs/reactions?sort=score&after=b", nil))
+	if w.Code != http.StatusNotAcceptable {
+		t.Errorf("bare uuid cursor: status %d, want %d", w.Code, http.StatusNotAcceptable)
+	}
+}
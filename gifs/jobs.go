@@ -0,0 +1,244 @@
+package gifs
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/csaunders/giftd/middleware"
+	"github.com/csaunders/giftd/models"
+	"github.com/zenazn/goji/web"
+)
+
+const jobsBucketName string = "giftd-jobs"
+const defaultImportWorkers int = 4
+
+const jobPending string = "pending"
+const jobFetching string = "fetching"
+const jobFailed string = "failed"
+const jobDone string = "done"
+
+// Job tracks a link import from the moment it is accepted until the GIF
+// has been stored or the import has failed.
+type Job struct {
+	Id           string    `json:"id"`
+	Status       string    `json:"status"`
+	Namespace    string    `json:"namespace"`
+	Link         string    `json:"link"`
+	KeepOriginal bool      `json:"keep-original"`
+	Tags         []string  `json:"tags"`
+	AccountId    string    `json:"account-id,omitempty"`
+	UUID         string    `json:"uuid,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	CreatedAt    time.Time `json:"created-at"`
+	UpdatedAt    time.Time `json:"updated-at"`
+}
+
+type importTask struct {
+	Datastore string
+	JobId     string
+	Env       web.C
+}
+
+var importQueue chan importTask = make(chan importTask)
+var importersStarted sync.Once
+
+func queueImport(task importTask) {
+	importersStarted.Do(func() {
+		workers := intSetting(task.Env, "import-workers", defaultImportWorkers)
+		for i := 0; i < workers; i++ {
+			go importWorker()
+		}
+	})
+	go func() {
+		importQueue <- task
+	}()
+}
+
+func importWorker() {
+	for task := range importQueue {
+		err := middleware.WithDatastore(task.Datastore, func(db *bolt.DB) error {
+			return runImport(db, task)
+		})
+		if err != nil {
+			log.Println("importWorker:", task.JobId, err)
+		}
+	}
+}
+
+func loadJob(db *bolt.DB, id string) (Job, error) {
+	var job Job
+	err := db.View(func(tx *bolt.Tx) error {
+		jobs := tx.Bucket([]byte(jobsBucketName))
+		if jobs == nil {
+			return models.RecordNotFound
+		}
+		return models.Load(jobs, id, &job)
+	})
+	return job, err
+}
+
+func saveJob(db *bolt.DB, job *Job) error {
+	job.UpdatedAt = time.Now().UTC()
+	return db.Update(func(tx *bolt.Tx) error {
+		jobs, err := tx.CreateBucketIfNotExists([]byte(jobsBucketName))
+		if err != nil {
+			return err
+		}
+		return models.Save(jobs, job.Id, job)
+	})
+}
+
+func runImport(db *bolt.DB, task importTask) error {
+	job, err := loadJob(db, task.JobId)
+	if err != nil || job.Status != jobPending {
+		return err
+	}
+	job.Status = jobFetching
+	if err = saveJob(db, &job); err != nil {
+		return err
+	}
+
+	bounds := limitsFor(task.Env)
+	content, meta, err := retrieveAndVerify(job.Link, job.KeepOriginal, bounds, fetcherFor(task.Env, bounds))
+	if err == nil {
+		job.UUID, _, err = saveGif(db, task.Env, job.Namespace, job.AccountId, job.Tags, content, meta)
+	}
+	if err != nil {
+		job.Status = jobFailed
+		job.Error = err.Error()
+	} else {
+		job.Status = jobDone
+	}
+	return saveJob(db, &job)
+}
+
+func enqueueImport(db *bolt.DB, c web.C, w http.ResponseWriter, r *http.Request) {
+	account, ok := c.Env[middleware.AccountDetails].(models.Account)
+	if !ok {
+		response(http.StatusUnauthorized, requestError{"Access Denied"}, c, w, r)
+		return
+	}
+	link, err := readLink(r.Body)
+	if err != nil {
+		rejectContent(err, c, w, r)
+		return
+	}
+	id, err := models.GenUUID()
+	if err != nil {
+		errorHandler(err, c, w, r)
+		return
+	}
+
+	job := Job{
+		Id:           id,
+		Status:       jobPending,
+		Namespace:    c.URLParams["namespace"],
+		Link:         link,
+		KeepOriginal: keepOriginal(r),
+		Tags:         parseTags(r.URL.Query().Get("tags")),
+		AccountId:    account.Id,
+		CreatedAt:    time.Now().UTC(),
+	}
+	if err = saveJob(db, &job); err != nil {
+		errorHandler(err, c, w, r)
+		return
+	}
+	queueImport(importTask{account.DatastoreName(), job.Id, c})
+
+	w.Header().Set("Location", fmt.Sprintf("/gifs/jobs/%s", job.Id))
+	response(http.StatusAccepted, job, c, w, r)
+}
+
+func showJob(db *bolt.DB, c web.C, w http.ResponseWriter, r *http.Request) {
+	id := c.URLParams["id"]
+	switch job, err := loadJob(db, id); err {
+	case nil:
+		if !authorized(models.ReadAccess, job.Namespace, c, w, r) {
+			return
+		}
+		response(http.StatusOK, job, c, w, r)
+	case models.RecordNotFound:
+		notFound(fmt.Sprintf("job %s does not exist", id), c, w, r)
+	default:
+		errorHandler(err, c, w, r)
+	}
+}
+
+func resumeImports(db *bolt.DB, datastore string, env web.C) error {
+	pending := []string{}
+	err := db.Update(func(tx *bolt.Tx) error {
+		jobs := tx.Bucket([]byte(jobsBucketName))
+		if jobs == nil {
+			return nil
+		}
+		cursor := jobs.Cursor()
+		for id, data := cursor.First(); id != nil; id, data = cursor.Next() {
+			var job Job
+			if err := json.Unmarshal(data, &job); err != nil {
+				return err
+			}
+			if job.Status != jobPending && job.Status != jobFetching {
+				continue
+			}
+			pending = append(pending, job.Id)
+			if job.Status == jobFetching {
+				job.Status = jobPending
+				if err := models.Save(jobs, job.Id, job); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	for _, id := range pending {
+		queueImport(importTask{datastore, id, env})
+	}
+	return err
+}
+
+// ResumeImports requeues link imports that were still pending or in flight
+// when giftd last stopped, for every datastore referenced by an account.
+func ResumeImports(configDb *bolt.DB, config map[string]interface{}) error {
+	env := web.C{Env: map[interface{}]interface{}{}}
+	for key, value := range config {
+		env.Env[key] = value
+	}
+
+	datastores := map[string]bool{}
+	err := configDb.View(func(tx *bolt.Tx) error {
+		clients, err := models.ApiClientsBucket(tx)
+		if err != nil {
+			return err
+		}
+		return clients.ForEach(func(token, data []byte) error {
+			var account models.Account
+			if err := json.Unmarshal(data, &account); err != nil {
+				return err
+			}
+			datastores[account.DatastoreName()] = true
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	for datastore := range datastores {
+		if _, err = os.Stat(datastore); os.IsNotExist(err) {
+			continue
+		}
+		err = middleware.WithDatastore(datastore, func(db *bolt.DB) error {
+			return resumeImports(db, datastore, env)
+		})
+		if err != nil {
+			log.Println("ResumeImports:", datastore, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package gifs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/zenazn/goji/web"
+)
+
+const defaultMaxUploadBytes int = 10 << 20
+const defaultMaxDimension int = 2048
+const defaultMaxFrames int = 1000
+const defaultMaxDecodedPixels int = 50000000
+
+var errMalformedGif error = errors.New("gif: malformed block structure")
+
+// limits bound the work giftd will do to verify an upload, so that a small
+// file cannot expand into an enormous amount of decoded image data.
+type limits struct {
+	MaxBytes     int64
+	MaxDimension int
+	MaxFrames    int
+	MaxPixels    int64
+}
+
+type contentError struct {
+	Status  int
+	Message string
+}
+
+func (e contentError) Error() string {
+	return e.Message
+}
+
+func limitsFor(c web.C) limits {
+	return limits{
+		MaxBytes:     int64(intSetting(c, "max-upload-bytes", defaultMaxUploadBytes)),
+		MaxDimension: intSetting(c, "max-dimension", defaultMaxDimension),
+		MaxFrames:    intSetting(c, "max-frames", defaultMaxFrames),
+		MaxPixels:    int64(intSetting(c, "max-decoded-pixels", defaultMaxDecodedPixels)),
+	}
+}
+
+func tooLarge(format string, args ...interface{}) error {
+	return contentError{http.StatusRequestEntityTooLarge, fmt.Sprintf(format, args...)}
+}
+
+func (l limits) read(r io.Reader) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, l.MaxBytes+1))
+	if err != nil {
+		return nil, err
+	} else if int64(len(data)) > l.MaxBytes {
+		return nil, tooLarge("Upload exceeds the maximum size of %d bytes", l.MaxBytes)
+	}
+	return data, nil
+}
+
+// check inspects the headers of content and rejects it before it is fully
+// decoded if it would exceed any of the limits.
+func (l limits) check(content []byte) error {
+	config, _, err := image.DecodeConfig(bytes.NewReader(content))
+	if err != nil {
+		return contentError{http.StatusUnsupportedMediaType, "Invalid Content"}
+	}
+	if config.Width > l.MaxDimension || config.Height > l.MaxDimension {
+		return tooLarge(
+			"Image is %dx%d, dimensions may not exceed %d",
+			config.Width, config.Height, l.MaxDimension,
+		)
+	}
+
+	frames, pixels := 1, int64(config.Width)*int64(config.Height)
+	if isGif(content) {
+		if frames, pixels, err = scanGif(content); err != nil {
+			return contentError{http.StatusUnsupportedMediaType, "Invalid Content"}
+		}
+	}
+	if frames > l.MaxFrames {
+		return tooLarge("Image has %d frames, the maximum is %d", frames, l.MaxFrames)
+	}
+	if pixels > l.MaxPixels {
+		return tooLarge("Image decodes to %d pixels, the maximum is %d", pixels, l.MaxPixels)
+	}
+	return nil
+}
+
+// scanGif walks the block structure of a GIF without decompressing any
+// frames, returning the number of frames and the pixels they cover.
+func scanGif(content []byte) (int, int64, error) {
+	if len(content) < 13 {
+		return 0, 0, errMalformedGif
+	}
+	pos := 13
+	if content[10]&0x80 != 0 {
+		pos += 3 << (uint(content[10]&0x07) + 1)
+	}
+	skipSubBlocks := func() bool {
+		for pos < len(content) {
+			size := int(content[pos])
+			pos++
+			if size == 0 {
+				return true
+			}
+			pos += size
+		}
+		return false
+	}
+
+	frames := 0
+	var pixels int64
+	for pos < len(content) {
+		switch content[pos] {
+		case 0x21:
+			pos += 2
+			if !skipSubBlocks() {
+				return frames, pixels, errMalformedGif
+			}
+		case 0x2C:
+			if pos+10 > len(content) {
+				return frames, pixels, errMalformedGif
+			}
+			width := binary.LittleEndian.Uint16(content[pos+5:])
+			height := binary.LittleEndian.Uint16(content[pos+7:])
+			packed := content[pos+9]
+			pos += 10
+			if packed&0x80 != 0 {
+				pos += 3 << (uint(packed&0x07) + 1)
+			}
+			pos++
+			if !skipSubBlocks() {
+				return frames, pixels, errMalformedGif
+			}
+			frames++
+			pixels += int64(width) * int64(height)
+		case 0x3B:
+			return frames, pixels, nil
+		default:
+			return frames, pixels, errMalformedGif
+		}
+	}
+	return frames, pixels, nil
+}
+
+func rejectContent(err error, c web.C, w http.ResponseWriter, r *http.Request) {
+	if rejected, ok := err.(contentError); ok {
+		response(rejected.Status, requestError{rejected.Message}, c, w, r)
+		return
+	}
+	response(
+		http.StatusUnsupportedMediaType,
+		requestError{"Invalid Content"},
+		c, w, r,
+	)
+}
@@ -0,0 +1,80 @@
+package gifs
+
+import (
+	"bytes"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"net/http"
+	"testing"
+)
+
+func encodeGif(t *testing.T, width, height, frames int) []byte {
+	t.Helper()
+	g := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		g.Image = append(g.Image, image.NewPaletted(image.Rect(0, 0, width, height), palette.Plan9))
+		g.Delay = append(g.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestScanGif(t *testing.T) {
+	content := encodeGif(t, 40, 30, 3)
+	frames, pixels, err := scanGif(content)
+	if err != nil {
+		t.Fatalf("scanGif: %v", err)
+	}
+	if frames != 3 || pixels != 3*40*30 {
+		t.Errorf("scanGif = %d frames, %d pixels; want 3 frames, %d pixels", frames, pixels, 3*40*30)
+	}
+}
+
+func TestScanGifMalformed(t *testing.T) {
+	content := encodeGif(t, 40, 30, 2)
+	trailer := len(content) - 1
+
+	cases := map[string][]byte{
+		"short header":   content[:10],
+		"unknown block":  append(append([]byte{}, content[:trailer]...), 0x99),
+		"truncated data": content[:trailer-4],
+	}
+	for name, data := range cases {
+		if _, _, err := scanGif(data); err != errMalformedGif {
+			t.Errorf("%s: scanGif error = %v, want %v", name, err, errMalformedGif)
+		}
+	}
+}
+
+func TestLimitsCheck(t *testing.T) {
+	bounds := limits{MaxBytes: 1 << 20, MaxDimension: 100, MaxFrames: 4, MaxPixels: 10000}
+
+	cases := []struct {
+		name    string
+		content []byte
+		status  int
+	}{
+		{"within limits", encodeGif(t, 50, 50, 4), 0},
+		{"too wide", encodeGif(t, 101, 10, 1), http.StatusRequestEntityTooLarge},
+		{"too many frames", encodeGif(t, 10, 10, 5), http.StatusRequestEntityTooLarge},
+		{"too many pixels", encodeGif(t, 60, 60, 3), http.StatusRequestEntityTooLarge},
+		{"not an image", []byte("not an image"), http.StatusUnsupportedMediaType},
+	}
+	for _, tc := range cases {
+		err := bounds.check(tc.content)
+		if tc.status == 0 {
+			if err != nil {
+				t.Errorf("%s: check = %v, want nil", tc.name, err)
+			}
+			continue
+		}
+		rejected, ok := err.(contentError)
+		if !ok || rejected.Status != tc.status {
+			t.Errorf("%s: check = %v, want status %d", tc.name, err, tc.status)
+		}
+	}
+}
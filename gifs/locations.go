@@ -0,0 +1,71 @@
+package gifs
+
+import (
+	"github.com/boltdb/bolt"
+)
+
+// The locations bucket maps each uuid to the namespace holding it, so a GIF
+// can be found without searching every namespace. Datastores written before
+// it existed are indexed in full by createBucket.
+const locationsBucketName string = "giftd-locations"
+
+func setLocation(tx *bolt.Tx, uuid, ns []byte) error {
+	locations, err := tx.CreateBucketIfNotExists([]byte(locationsBucketName))
+	if err != nil {
+		return err
+	}
+	return locations.Put(uuid, ns)
+}
+
+func clearLocation(tx *bolt.Tx, uuid []byte) error {
+	locations := tx.Bucket([]byte(locationsBucketName))
+	if locations == nil {
+		return nil
+	}
+	return locations.Delete(uuid)
+}
+
+// indexLocations records the namespace of every GIF, unless the datastore
+// has already been indexed.
+func indexLocations(tx *bolt.Tx) error {
+	if tx.Bucket([]byte(locationsBucketName)) != nil {
+		return nil
+	}
+	locations, err := tx.CreateBucket([]byte(locationsBucketName))
+	if err != nil {
+		return err
+	}
+	rootBucket := tx.Bucket([]byte(root))
+	registry := rootBucket.Bucket([]byte(namespacesBucketName))
+	if registry == nil {
+		return nil
+	}
+	return registry.ForEach(func(ns, _ []byte) error {
+		bucketForNamespace := rootBucket.Bucket(ns)
+		if bucketForNamespace == nil {
+			return nil
+		}
+		return bucketForNamespace.ForEach(func(uuid, _ []byte) error {
+			return locations.Put(uuid, ns)
+		})
+	})
+}
+
+// scanNamespaces searches every namespace for uuid, for datastores that have
+// not been indexed yet.
+func scanNamespaces(tx *bolt.Tx, uuid []byte) []byte {
+	rootBucket := tx.Bucket([]byte(root))
+	namespacesBucket := rootBucket.Bucket([]byte(namespacesBucketName))
+	if namespacesBucket == nil {
+		return nil
+	}
+	var found []byte
+	cursor := namespacesBucket.Cursor()
+	for ns, _ := cursor.First(); ns != nil; ns, _ = cursor.Next() {
+		if b := rootBucket.Bucket(ns); b != nil && b.Get(uuid) != nil {
+			found = append([]byte{}, ns...)
+			break
+		}
+	}
+	return found
+}
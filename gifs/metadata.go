@@ -0,0 +1,272 @@
+package gifs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/gif"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/zenazn/goji/web"
+)
+
+const sourceUpload string = "upload"
+const sourceLink string = "link"
+const sourceArchive string = "archive"
+
+// Changes made once to a whole datastore are recorded in the migrations
+// bucket so that they are not repeated.
+const migrationsBucketName string = "giftd-migrations"
+const metadataMigration string = "metadata"
+
+// Metadata is the record stored as the value of a uuid in its namespace
+// bucket. Older datastores hold a literal "{}" instead, which is filled in
+// from the stored blob the first time it is requested.
+type Metadata struct {
+	Namespace  string    `json:"namespace"`
+	Title      string    `json:"title,omitempty"`
+	Size       int       `json:"size"`
+	Width      int       `json:"width"`
+	Height     int       `json:"height"`
+	Frames     int       `json:"frames"`
+	Duration   int       `json:"duration-ms"`
+	LoopCount  int       `json:"loop-count"`
+	UploadedAt time.Time `json:"uploaded-at"`
+	AccountId  string    `json:"account-id,omitempty"`
+	Source     string    `json:"source,omitempty"`
+	Url        string    `json:"url,omitempty"`
+	Hash       string    `json:"hash"`
+	Tags       []string  `json:"tags"`
+	Format     string    `json:"format"`
+	Weight     float64   `json:"weight,omitempty"`
+	Score      int       `json:"score"`
+}
+
+func (m Metadata) legacy() bool {
+	return len(m.Hash) <= 0
+}
+
+func contentHash(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func describeGif(content []byte) (Metadata, error) {
+	var meta Metadata
+	if !isGif(content) {
+		config, format, err := image.DecodeConfig(bytes.NewReader(content))
+		if err != nil {
+			return meta, err
+		}
+		meta.Size = len(content)
+		meta.Width = config.Width
+		meta.Height = config.Height
+		meta.Frames = 1
+		meta.LoopCount = -1
+		meta.Hash = contentHash(content)
+		meta.Format = format
+		return meta, nil
+	}
+
+	g, err := gif.DecodeAll(bytes.NewReader(content))
+	if err != nil {
+		return meta, err
+	}
+	meta.Size = len(content)
+	meta.Width = g.Config.Width
+	meta.Height = g.Config.Height
+	meta.Frames = len(g.Image)
+	meta.LoopCount = g.LoopCount
+	for _, delay := range g.Delay {
+		meta.Duration += delay * 10
+	}
+	meta.Hash = contentHash(content)
+	meta.Format = formatGif
+	return meta, nil
+}
+
+func findNamespace(tx *bolt.Tx, uuid []byte) []byte {
+	locations := tx.Bucket([]byte(locationsBucketName))
+	if locations == nil {
+		return scanNamespaces(tx, uuid)
+	}
+	ns := locations.Get(uuid)
+	if ns == nil || !inNamespace(tx, ns, uuid) {
+		return nil
+	}
+	return append([]byte{}, ns...)
+}
+
+func readMetadata(tx *bolt.Tx, uuid []byte) (Metadata, bool, error) {
+	var meta Metadata
+	ns := findNamespace(tx, uuid)
+	if ns == nil {
+		return meta, false, nil
+	}
+	raw := tx.Bucket([]byte(root)).Bucket(ns).Get(uuid)
+	if err := json.Unmarshal(raw, &meta); err != nil {
+		return meta, true, err
+	}
+	meta.Namespace = string(ns)
+	return meta, true, nil
+}
+
+func writeMetadata(tx *bolt.Tx, uuid []byte, meta Metadata) error {
+	bucketForNamespace := tx.Bucket([]byte(root)).Bucket([]byte(meta.Namespace))
+	if bucketForNamespace == nil {
+		return fmt.Errorf("writeMetadata: namespace %s does not exist", meta.Namespace)
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if err = bucketForNamespace.Put(uuid, data); err != nil {
+		return err
+	}
+	if err = setLocation(tx, uuid, []byte(meta.Namespace)); err != nil {
+		return err
+	}
+	return reweighGif(tx, []byte(meta.Namespace), uuid)
+}
+
+// backfillMetadata describes the stored content of a legacy record, keeping
+// anything recorded against it since, and moves the content into a shared
+// blob. Records have no upload time of their own, so uploadedAt is used.
+func backfillMetadata(tx *bolt.Tx, uuid []byte, meta Metadata, uploadedAt time.Time) (Metadata, error) {
+	content := readBlob(tx, uuid)
+	if content == nil {
+		return meta, fmt.Errorf("backfillMetadata: %s has no content", uuid)
+	}
+	described, err := describeGif(content)
+	if err != nil {
+		return meta, err
+	}
+	described.Namespace = meta.Namespace
+	described.Title = meta.Title
+	described.AccountId = meta.AccountId
+	described.Source = meta.Source
+	described.Url = meta.Url
+	described.Tags = meta.Tags
+	described.Weight = meta.Weight
+	described.Score = meta.Score
+	described.UploadedAt = meta.UploadedAt
+	if described.UploadedAt.IsZero() {
+		described.UploadedAt = uploadedAt
+	}
+	if err = writeMetadata(tx, uuid, described); err != nil {
+		return meta, err
+	}
+	if _, shared := blobHash(tx.Bucket([]byte(root)).Get(uuid)); shared {
+		return described, nil
+	}
+	content = append([]byte{}, content...)
+	if err = detachBlob(tx, uuid); err != nil {
+		return meta, err
+	}
+	return described, attachBlob(tx, uuid, content)
+}
+
+// legacyUploadTime is the upload time given to legacy records: the oldest
+// upload time known to the datastore, or now if nothing has one.
+func legacyUploadTime(tx *bolt.Tx) time.Time {
+	oldest := time.Now().UTC()
+	rootBucket := tx.Bucket([]byte(root))
+	registry := rootBucket.Bucket([]byte(namespacesBucketName))
+	if registry == nil {
+		return oldest
+	}
+	registry.ForEach(func(ns, _ []byte) error {
+		if bucketForNamespace := rootBucket.Bucket(ns); bucketForNamespace != nil {
+			bucketForNamespace.ForEach(func(_, data []byte) error {
+				var meta Metadata
+				if json.Unmarshal(data, &meta) == nil && !meta.UploadedAt.IsZero() && meta.UploadedAt.Before(oldest) {
+					oldest = meta.UploadedAt
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	return oldest
+}
+
+// backfillLegacyMetadata backfills every legacy record once, so that
+// listings, exports and random picks never see empty metadata. Records whose
+// content cannot be described are logged and left to loadMetadata.
+func backfillLegacyMetadata(tx *bolt.Tx) error {
+	migrations, err := tx.CreateBucketIfNotExists([]byte(migrationsBucketName))
+	if err != nil {
+		return err
+	}
+	if migrations.Get([]byte(metadataMigration)) != nil {
+		return nil
+	}
+
+	rootBucket := tx.Bucket([]byte(root))
+	legacy := map[string]Metadata{}
+	if registry := rootBucket.Bucket([]byte(namespacesBucketName)); registry != nil {
+		registry.ForEach(func(ns, _ []byte) error {
+			if bucketForNamespace := rootBucket.Bucket(ns); bucketForNamespace != nil {
+				bucketForNamespace.ForEach(func(uuid, data []byte) error {
+					var meta Metadata
+					if json.Unmarshal(data, &meta) == nil && meta.legacy() {
+						meta.Namespace = string(ns)
+						legacy[string(uuid)] = meta
+					}
+					return nil
+				})
+			}
+			return nil
+		})
+	}
+	if len(legacy) > 0 {
+		uploadedAt := legacyUploadTime(tx)
+		for uuid, meta := range legacy {
+			if _, err = backfillMetadata(tx, []byte(uuid), meta, uploadedAt); err != nil {
+				log.Println("backfillLegacyMetadata:", uuid, err)
+			}
+		}
+	}
+	return migrations.Put([]byte(metadataMigration), []byte(time.Now().UTC().Format(time.RFC3339)))
+}
+
+// loadMetadata returns the metadata for uuid, backfilling it if it is a
+// legacy record.
+func loadMetadata(db *bolt.DB, uuid []byte) (Metadata, bool, error) {
+	var meta Metadata
+	var found bool
+	err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		meta, found, err = readMetadata(tx, uuid)
+		return err
+	})
+	if err != nil || !found || !meta.legacy() {
+		return meta, found, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		var err error
+		meta, err = backfillMetadata(tx, uuid, meta, legacyUploadTime(tx))
+		return err
+	})
+	return meta, found, err
+}
+
+func showInfo(db *bolt.DB, c web.C, w http.ResponseWriter, r *http.Request) {
+	uuid := c.URLParams["uuid"]
+	meta, found, err := loadMetadata(db, []byte(uuid))
+	if err != nil {
+		errorHandler(err, c, w, r)
+		return
+	} else if !found {
+		notFound(fmt.Sprintf("%s does not exist", uuid), c, w, r)
+		return
+	}
+	response(http.StatusOK, meta, c, w, r)
+}
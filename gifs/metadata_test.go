@@ -0,0 +1,53 @@
+package gifs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestCreateBucketBackfillsLegacyMetadata(t *testing.T) {
+	db := openTestDB(t)
+	ns := []byte("reactions")
+	uploadedAt := time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC)
+	if _, _, err := storeGif(db, ns, []byte("modern"), encodeGif(t, 12, 10, 1), Metadata{UploadedAt: uploadedAt}); err != nil {
+		t.Fatal(err)
+	}
+	content := encodeGif(t, 20, 10, 2)
+	err := db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket([]byte(root)).Put([]byte("legacy"), content); err != nil {
+			return err
+		}
+		if err := tx.Bucket([]byte(root)).Bucket(ns).Put([]byte("legacy"), []byte(`{"score":3}`)); err != nil {
+			return err
+		}
+		return tx.DeleteBucket([]byte(migrationsBucketName))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = createBucket(db); err != nil {
+		t.Fatal(err)
+	}
+	db.View(func(tx *bolt.Tx) error {
+		meta, found, err := readMetadata(tx, []byte("legacy"))
+		if err != nil || !found {
+			t.Fatalf("readMetadata = %v, %v", found, err)
+		}
+		if meta.legacy() || meta.Width != 20 || meta.Frames != 2 {
+			t.Errorf("metadata was not backfilled: %+v", meta)
+		}
+		if !meta.UploadedAt.Equal(uploadedAt) {
+			t.Errorf("UploadedAt = %v, want the oldest known upload %v", meta.UploadedAt, uploadedAt)
+		}
+		if meta.Score != 3 {
+			t.Errorf("Score = %d, want the recorded 3", meta.Score)
+		}
+		if _, shared := blobHash(tx.Bucket([]byte(root)).Get([]byte("legacy"))); !shared {
+			t.Error("content was not moved into a shared blob")
+		}
+		return nil
+	})
+}
@@ -0,0 +1,267 @@
+package gifs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/csaunders/giftd/middleware"
+	"github.com/csaunders/giftd/models"
+	"github.com/zenazn/goji/web"
+)
+
+const reportsBucketName string = "giftd-reports"
+const reportersBucketName string = "giftd-reporters"
+const quarantineBucketName string = "giftd-quarantine"
+
+const defaultReportThreshold int = 3
+const defaultReportRateLimit int = 10
+const reportRateWindow time.Duration = time.Hour
+
+var errRateLimited error = errors.New("report rate limit exceeded")
+
+type Report struct {
+	Reporter   string    `json:"reporter"`
+	Reason     string    `json:"reason"`
+	ReportedAt time.Time `json:"reported-at"`
+}
+
+// ModerationEntry describes a reported GIF along with every report made
+// against it.
+type ModerationEntry struct {
+	UUID        string   `json:"uuid"`
+	Quarantined bool     `json:"quarantined"`
+	Metadata    Metadata `json:"metadata"`
+	Reports     []Report `json:"reports"`
+}
+
+type reporterWindow struct {
+	Start time.Time `json:"window-start"`
+	Count int       `json:"count"`
+}
+
+func reporterIdentity(c web.C, r *http.Request) string {
+	if account, ok := c.Env[middleware.AccountDetails].(models.Account); ok && len(account.Id) > 0 {
+		return "account:" + account.Id
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+func isQuarantined(tx *bolt.Tx, uuid []byte) bool {
+	quarantine := tx.Bucket([]byte(quarantineBucketName))
+	return quarantine != nil && quarantine.Get(uuid) != nil
+}
+
+func throttleReporter(tx *bolt.Tx, reporter string, limit int, now time.Time) error {
+	reporters, err := tx.CreateBucketIfNotExists([]byte(reportersBucketName))
+	if err != nil {
+		return err
+	}
+	var window reporterWindow
+	if err = models.Load(reporters, reporter, &window); err != nil && err != models.RecordNotFound {
+		return err
+	}
+	if now.Sub(window.Start) > reportRateWindow {
+		window = reporterWindow{Start: now}
+	}
+	if window.Count >= limit {
+		return errRateLimited
+	}
+	window.Count++
+	return models.Save(reporters, reporter, window)
+}
+
+func quarantineGif(tx *bolt.Tx, ns, uuid []byte) error {
+	bucketForNamespace := tx.Bucket([]byte(root)).Bucket(ns)
+	var meta Metadata
+	if err := json.Unmarshal(bucketForNamespace.Get(uuid), &meta); err != nil {
+		return err
+	}
+	meta.Namespace = string(ns)
+
+	quarantine, err := tx.CreateBucketIfNotExists([]byte(quarantineBucketName))
+	if err != nil {
+		return err
+	}
+	if err = models.Save(quarantine, string(uuid), meta); err != nil {
+		return err
+	}
+	info := append([]byte{}, namespacesBucket(tx).Get(ns)...)
+	if err = removeFromNamespace(tx, ns, uuid); err != nil {
+		return err
+	}
+	if tx.Bucket([]byte(root)).Bucket(ns) != nil || len(info) <= 0 {
+		return nil
+	}
+	return keepEmptiedNamespace(tx, ns, info)
+}
+
+func countKeys(b *bolt.Bucket) int {
+	count := 0
+	cursor := b.Cursor()
+	for k, _ := cursor.First(); k != nil; k, _ = cursor.Next() {
+		count++
+	}
+	return count
+}
+
+func recordReport(db *bolt.DB, uuid []byte, report Report, threshold, limit int) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		ns := findNamespace(tx, uuid)
+		quarantined := isQuarantined(tx, uuid)
+		if ns == nil && !quarantined {
+			return models.RecordNotFound
+		}
+		if err := throttleReporter(tx, report.Reporter, limit, report.ReportedAt); err != nil {
+			return err
+		}
+
+		reports, err := tx.CreateBucketIfNotExists([]byte(reportsBucketName))
+		if err != nil {
+			return err
+		}
+		reportsForGif, err := reports.CreateBucketIfNotExists(uuid)
+		if err != nil {
+			return err
+		}
+		if err = models.Save(reportsForGif, report.Reporter, report); err != nil {
+			return err
+		}
+
+		if !quarantined && countKeys(reportsForGif) >= threshold {
+			return quarantineGif(tx, ns, uuid)
+		}
+		return nil
+	})
+}
+
+func moderationEntry(tx *bolt.Tx, uuid []byte, reportsForGif *bolt.Bucket) (ModerationEntry, error) {
+	entry := ModerationEntry{UUID: string(uuid), Reports: []Report{}}
+	err := reportsForGif.ForEach(func(reporter, data []byte) error {
+		var report Report
+		if err := json.Unmarshal(data, &report); err != nil {
+			return err
+		}
+		entry.Reports = append(entry.Reports, report)
+		return nil
+	})
+	if err != nil {
+		return entry, err
+	}
+
+	if entry.Quarantined = isQuarantined(tx, uuid); entry.Quarantined {
+		err = models.Load(tx.Bucket([]byte(quarantineBucketName)), string(uuid), &entry.Metadata)
+	} else {
+		entry.Metadata, _, err = readMetadata(tx, uuid)
+	}
+	return entry, err
+}
+
+// ModerationQueue lists every GIF in the datastore that has been reported at
+// least once, quarantined or not.
+func ModerationQueue(db *bolt.DB) ([]ModerationEntry, error) {
+	entries := []ModerationEntry{}
+	err := db.View(func(tx *bolt.Tx) error {
+		reports := tx.Bucket([]byte(reportsBucketName))
+		if reports == nil || tx.Bucket([]byte(root)) == nil {
+			return nil
+		}
+		cursor := reports.Cursor()
+		for uuid, _ := cursor.First(); uuid != nil; uuid, _ = cursor.Next() {
+			entry, err := moderationEntry(tx, uuid, reports.Bucket(uuid))
+			if err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	return entries, err
+}
+
+func clearReports(tx *bolt.Tx, uuid []byte) error {
+	reports := tx.Bucket([]byte(reportsBucketName))
+	if reports == nil || reports.Bucket(uuid) == nil {
+		return nil
+	}
+	return reports.DeleteBucket(uuid)
+}
+
+// RestoreGif dismisses all reports against uuid and, if it was quarantined,
+// returns it to the namespace it was uploaded to.
+func RestoreGif(db *bolt.DB, uuid string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		rootBucket := tx.Bucket([]byte(root))
+		if rootBucket == nil || rootBucket.Get([]byte(uuid)) == nil {
+			return models.RecordNotFound
+		}
+		if isQuarantined(tx, []byte(uuid)) {
+			quarantine := tx.Bucket([]byte(quarantineBucketName))
+			var meta Metadata
+			if err := models.Load(quarantine, uuid, &meta); err != nil {
+				return err
+			}
+			if _, err := rootBucket.CreateBucketIfNotExists([]byte(meta.Namespace)); err != nil {
+				return err
+			}
+			if err := registerNamespace(tx, []byte(meta.Namespace)); err != nil {
+				return err
+			}
+			if err := writeMetadata(tx, []byte(uuid), meta); err != nil {
+				return err
+			}
+			if err := addPosition(tx, []byte(meta.Namespace), []byte(uuid)); err != nil {
+				return err
+			}
+			if err := quarantine.Delete([]byte(uuid)); err != nil {
+				return err
+			}
+		}
+		return clearReports(tx, []byte(uuid))
+	})
+}
+
+// RemoveGif permanently deletes a reported GIF along with its reports.
+func RemoveGif(db *bolt.DB, uuid string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return destroyGif(tx, []byte(uuid))
+	})
+}
+
+func reportGif(db *bolt.DB, c web.C, w http.ResponseWriter, r *http.Request) {
+	uuid := c.URLParams["uuid"]
+	var params struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil || len(params.Reason) <= 0 {
+		response(http.StatusNotAcceptable, requestError{"A reason for the report is required"}, c, w, r)
+		return
+	}
+
+	report := Report{
+		Reporter:   reporterIdentity(c, r),
+		Reason:     params.Reason,
+		ReportedAt: time.Now().UTC(),
+	}
+	threshold := intSetting(c, "report-threshold", defaultReportThreshold)
+	limit := intSetting(c, "report-rate-limit", defaultReportRateLimit)
+
+	switch err := recordReport(db, []byte(uuid), report, threshold, limit); err {
+	case nil:
+		response(http.StatusAccepted, struct{}{}, c, w, r)
+	case models.RecordNotFound:
+		notFound(fmt.Sprintf("%s does not exist", uuid), c, w, r)
+	case errRateLimited:
+		response(http.StatusTooManyRequests, requestError{"Too many reports, try again later"}, c, w, r)
+	default:
+		errorHandler(err, c, w, r)
+	}
+}
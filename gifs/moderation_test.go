@@ -0,0 +1,75 @@
+package gifs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestRestoreGifKeepsNamespaceInfo(t *testing.T) {
+	db := openTestDB(t)
+	ns := []byte("reactions")
+	if _, _, err := storeGif(db, ns, []byte("gif-0"), encodeGif(t, 10, 10, 1), Metadata{}); err != nil {
+		t.Fatal(err)
+	}
+	want := NamespaceInfo{Name: "reactions", DisplayName: "Reactions", NSFW: true, RandomStrategy: strategyFresh}
+	if err := db.Update(func(tx *bolt.Tx) error { return writeNamespaceInfo(tx, ns, want) }); err != nil {
+		t.Fatal(err)
+	}
+
+	report := Report{Reporter: "ip:192.0.2.1", Reason: "spam", ReportedAt: time.Now().UTC()}
+	if err := recordReport(db, []byte("gif-0"), report, 1, defaultReportRateLimit); err != nil {
+		t.Fatal(err)
+	}
+	db.View(func(tx *bolt.Tx) error {
+		if !isQuarantined(tx, []byte("gif-0")) || tx.Bucket([]byte(root)).Bucket(ns) != nil {
+			t.Fatal("reporting the last GIF did not quarantine it and empty the namespace")
+		}
+		return nil
+	})
+
+	if err := RestoreGif(db, "gif-0"); err != nil {
+		t.Fatal(err)
+	}
+	db.View(func(tx *bolt.Tx) error {
+		info, found, err := readNamespaceInfo(tx, ns)
+		if err != nil || !found {
+			t.Fatalf("readNamespaceInfo: found %v, %v", found, err)
+		}
+		if info != want {
+			t.Errorf("restored namespace info %+v, want %+v", info, want)
+		}
+		return nil
+	})
+}
+
+func TestDeletingLastQuarantinedGifDropsNamespaceInfo(t *testing.T) {
+	db := openTestDB(t)
+	ns := []byte("reactions")
+	if _, _, err := storeGif(db, ns, []byte("gif-0"), encodeGif(t, 10, 10, 1), Metadata{}); err != nil {
+		t.Fatal(err)
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		if err := writeNamespaceInfo(tx, ns, NamespaceInfo{NSFW: true}); err != nil {
+			return err
+		}
+		if err := quarantineGif(tx, ns, []byte("gif-0")); err != nil {
+			return err
+		}
+		return destroyGif(tx, []byte("gif-0"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := storeGif(db, ns, []byte("gif-1"), encodeGif(t, 12, 10, 1), Metadata{}); err != nil {
+		t.Fatal(err)
+	}
+	db.View(func(tx *bolt.Tx) error {
+		if info, _, _ := readNamespaceInfo(tx, ns); info.NSFW {
+			t.Error("a new namespace took on the metadata of the deleted one")
+		}
+		return nil
+	})
+}
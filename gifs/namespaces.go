@@ -0,0 +1,530 @@
+package gifs
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/csaunders/giftd/models"
+	"github.com/zenazn/goji/web"
+)
+
+// NamespaceInfo is the record stored for each namespace in the namespaces
+// bucket. Older datastores hold a literal "{}", which reads as empty
+// metadata.
+type NamespaceInfo struct {
+	Name           string `json:"name,omitempty"`
+	DisplayName    string `json:"display-name,omitempty"`
+	Description    string `json:"description,omitempty"`
+	NSFW           bool   `json:"nsfw"`
+	RandomStrategy string `json:"random-strategy,omitempty"`
+}
+
+// Namespaces emptied by quarantine keep their metadata in the emptied
+// namespaces bucket, so that it comes back when a GIF is restored or
+// uploaded to them again.
+const emptiedNamespacesBucketName string = "giftd-emptied-namespaces"
+
+type namespaceConflict struct {
+	Namespace string
+}
+
+func (e namespaceConflict) Error() string {
+	return fmt.Sprintf("%s already exists", e.Namespace)
+}
+
+var invalidNamespaceMessage string = fmt.Sprintf("Namespaces must be made of a-z, 0-9, - and _ and may not be any of %s", strings.Join(fixedSegments, ", "))
+
+func validNamespace(name string) bool {
+	for _, segment := range fixedSegments {
+		if name == segment {
+			return false
+		}
+	}
+	return models.NamespacePattern.MatchString(name)
+}
+
+func namespacesBucket(tx *bolt.Tx) *bolt.Bucket {
+	return tx.Bucket([]byte(root)).Bucket([]byte(namespacesBucketName))
+}
+
+// registerNamespace records ns in the namespaces bucket without disturbing
+// any metadata it already has.
+func registerNamespace(tx *bolt.Tx, ns []byte) error {
+	namespaces, err := tx.Bucket([]byte(root)).CreateBucketIfNotExists([]byte(namespacesBucketName))
+	if err != nil {
+		return err
+	}
+	if namespaces.Get(ns) != nil {
+		return nil
+	}
+	info := []byte("{}")
+	if emptied := tx.Bucket([]byte(emptiedNamespacesBucketName)); emptied != nil && emptied.Get(ns) != nil {
+		info = append([]byte{}, emptied.Get(ns)...)
+		if err = emptied.Delete(ns); err != nil {
+			return err
+		}
+	}
+	return namespaces.Put(ns, info)
+}
+
+// keepEmptiedNamespace holds on to info, the metadata of ns, after ns has
+// been emptied by quarantine.
+func keepEmptiedNamespace(tx *bolt.Tx, ns, info []byte) error {
+	emptied, err := tx.CreateBucketIfNotExists([]byte(emptiedNamespacesBucketName))
+	if err != nil {
+		return err
+	}
+	return emptied.Put(ns, info)
+}
+
+func dropEmptiedNamespace(tx *bolt.Tx, ns []byte) error {
+	emptied := tx.Bucket([]byte(emptiedNamespacesBucketName))
+	if emptied == nil {
+		return nil
+	}
+	return emptied.Delete(ns)
+}
+
+// pruneEmptiedNamespace drops the metadata kept for ns once the last GIF
+// quarantined from it has been deleted.
+func pruneEmptiedNamespace(tx *bolt.Tx, ns []byte) error {
+	emptied := tx.Bucket([]byte(emptiedNamespacesBucketName))
+	if emptied == nil || emptied.Get(ns) == nil {
+		return nil
+	}
+	remaining, err := quarantinedFrom(tx, ns)
+	if err != nil || len(remaining) > 0 {
+		return err
+	}
+	return emptied.Delete(ns)
+}
+
+func readNamespaceInfo(tx *bolt.Tx, ns []byte) (NamespaceInfo, bool, error) {
+	var info NamespaceInfo
+	namespaces := namespacesBucket(tx)
+	if namespaces == nil || tx.Bucket([]byte(root)).Bucket(ns) == nil {
+		return info, false, nil
+	}
+	if data := namespaces.Get(ns); data != nil {
+		if err := json.Unmarshal(data, &info); err != nil {
+			return info, true, err
+		}
+	}
+	info.Name = string(ns)
+	return info, true, nil
+}
+
+func writeNamespaceInfo(tx *bolt.Tx, ns []byte, info NamespaceInfo) error {
+	info.Name = ""
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return namespacesBucket(tx).Put(ns, data)
+}
+
+// quarantinedFrom returns the quarantined GIFs that were uploaded to ns.
+func quarantinedFrom(tx *bolt.Tx, ns []byte) ([][]byte, error) {
+	uuids := [][]byte{}
+	quarantine := tx.Bucket([]byte(quarantineBucketName))
+	if quarantine == nil {
+		return uuids, nil
+	}
+	err := quarantine.ForEach(func(uuid, data []byte) error {
+		var meta Metadata
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return err
+		}
+		if meta.Namespace == string(ns) {
+			uuids = append(uuids, append([]byte{}, uuid...))
+		}
+		return nil
+	})
+	return uuids, err
+}
+
+func requarantine(tx *bolt.Tx, from, to []byte) error {
+	uuids, err := quarantinedFrom(tx, from)
+	if err != nil {
+		return err
+	}
+	quarantine := tx.Bucket([]byte(quarantineBucketName))
+	for _, uuid := range uuids {
+		var meta Metadata
+		if err = models.Load(quarantine, string(uuid), &meta); err != nil {
+			return err
+		}
+		meta.Namespace = string(to)
+		if err = models.Save(quarantine, string(uuid), meta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveStats folds the usage recorded for from into to, or discards it when
+// to is nil.
+func moveStats(tx *bolt.Tx, from, to []byte) error {
+	for _, name := range []string{namespaceStatsBucketName, dailyStatsBucketName} {
+		b := statsBucket(tx, name)
+		if b == nil {
+			continue
+		}
+		prefix := string(from) + "/"
+		moved := map[string]statCounts{}
+		cursor := b.Cursor()
+		for k, v := cursor.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, v = cursor.Next() {
+			var counts statCounts
+			if err := json.Unmarshal(v, &counts); err != nil {
+				return err
+			}
+			moved[string(k)] = counts
+		}
+		for key, counts := range moved {
+			if err := b.Delete([]byte(key)); err != nil {
+				return err
+			}
+			if to == nil {
+				continue
+			}
+			if err := addStats(b, string(to)+"/"+strings.TrimPrefix(key, prefix), counts); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func dropDailyPick(tx *bolt.Tx, ns []byte) error {
+	daily := tx.Bucket([]byte(dailyBucketName))
+	if daily == nil {
+		return nil
+	}
+	return daily.Delete(ns)
+}
+
+// forgetNamespace removes everything kept about ns apart from its GIFs.
+func forgetNamespace(tx *bolt.Tx, ns []byte) error {
+	if namespaces := namespacesBucket(tx); namespaces != nil {
+		if err := namespaces.Delete(ns); err != nil {
+			return err
+		}
+	}
+	if err := dropEmptiedNamespace(tx, ns); err != nil {
+		return err
+	}
+	if err := dropPositions(tx, ns); err != nil {
+		return err
+	}
+	if err := dropBags(tx, ns); err != nil {
+		return err
+	}
+	return dropDailyPick(tx, ns)
+}
+
+// renameNamespace moves every GIF in from, along with its metadata, usage
+// and today's pick, to the new namespace to within a single transaction.
+func renameNamespace(tx *bolt.Tx, from, to []byte) error {
+	rootBucket := tx.Bucket([]byte(root))
+	source := rootBucket.Bucket(from)
+	if source == nil {
+		return models.RecordNotFound
+	}
+	if rootBucket.Bucket(to) != nil {
+		return namespaceConflict{string(to)}
+	}
+	info, _, err := readNamespaceInfo(tx, from)
+	if err != nil {
+		return err
+	}
+	var pick []byte
+	if daily := tx.Bucket([]byte(dailyBucketName)); daily != nil && daily.Get(from) != nil {
+		pick = append([]byte{}, daily.Get(from)...)
+	}
+
+	destination, err := rootBucket.CreateBucket(to)
+	if err != nil {
+		return err
+	}
+	err = source.ForEach(func(uuid, data []byte) error {
+		var meta Metadata
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return err
+		}
+		meta.Namespace = string(to)
+		data, err := json.Marshal(meta)
+		if err != nil {
+			return err
+		}
+		if err = destination.Put(uuid, data); err != nil {
+			return err
+		}
+		return setLocation(tx, uuid, to)
+	})
+	if err != nil {
+		return err
+	}
+	if err = rootBucket.DeleteBucket(from); err != nil {
+		return err
+	}
+	if err = registerNamespace(tx, to); err != nil {
+		return err
+	}
+	if err = writeNamespaceInfo(tx, to, info); err != nil {
+		return err
+	}
+	if err = forgetNamespace(tx, from); err != nil {
+		return err
+	}
+	if err = indexNamespace(tx, to); err != nil {
+		return err
+	}
+	if pick != nil {
+		if err = tx.Bucket([]byte(dailyBucketName)).Put(to, pick); err != nil {
+			return err
+		}
+	}
+	if err = requarantine(tx, from, to); err != nil {
+		return err
+	}
+	return moveStats(tx, from, to)
+}
+
+// mergeNamespace moves every GIF in from into the existing namespace into.
+// GIFs whose content into already holds are removed, with their tags added
+// to the copy that is kept.
+func mergeNamespace(tx *bolt.Tx, from, into []byte) error {
+	rootBucket := tx.Bucket([]byte(root))
+	source := rootBucket.Bucket(from)
+	destination := rootBucket.Bucket(into)
+	if source == nil || destination == nil {
+		return models.RecordNotFound
+	}
+
+	uuids := [][]byte{}
+	source.ForEach(func(uuid, _ []byte) error {
+		uuids = append(uuids, append([]byte{}, uuid...))
+		return nil
+	})
+	for _, uuid := range uuids {
+		meta, _, err := readMetadata(tx, uuid)
+		if err != nil {
+			return err
+		}
+		var existing []byte
+		if hash := derivativeKey(tx, uuid); hash != nil {
+			for _, other := range blobReferences(tx, string(hash)) {
+				if inNamespace(tx, into, other) {
+					existing = other
+					break
+				}
+			}
+		}
+		if existing != nil {
+			if err = mergeTags(tx, existing, meta.Tags); err != nil {
+				return err
+			}
+			if err = destroyGif(tx, uuid); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err = removeFromNamespace(tx, from, uuid); err != nil {
+			return err
+		}
+		meta.Namespace = string(into)
+		if err = writeMetadata(tx, uuid, meta); err != nil {
+			return err
+		}
+		if err = addPosition(tx, into, uuid); err != nil {
+			return err
+		}
+	}
+	if err := forgetNamespace(tx, from); err != nil {
+		return err
+	}
+	if err := requarantine(tx, from, into); err != nil {
+		return err
+	}
+	return moveStats(tx, from, into)
+}
+
+func mergeTags(tx *bolt.Tx, uuid []byte, tags []string) error {
+	meta, _, err := readMetadata(tx, uuid)
+	if err != nil {
+		return err
+	}
+	merged := normalizeTags(append(append([]string{}, meta.Tags...), tags...))
+	if err = unindexTags(tx, uuid, meta.Tags); err != nil {
+		return err
+	}
+	if err = indexTags(tx, uuid, merged); err != nil {
+		return err
+	}
+	meta.Tags = merged
+	return writeMetadata(tx, uuid, meta)
+}
+
+// deleteNamespace permanently deletes every GIF in ns, including any
+// awaiting moderation, along with everything kept about the namespace.
+func deleteNamespace(tx *bolt.Tx, ns []byte) error {
+	bucketForNamespace := tx.Bucket([]byte(root)).Bucket(ns)
+	if bucketForNamespace == nil {
+		return models.RecordNotFound
+	}
+	uuids, err := quarantinedFrom(tx, ns)
+	if err != nil {
+		return err
+	}
+	bucketForNamespace.ForEach(func(uuid, _ []byte) error {
+		uuids = append(uuids, append([]byte{}, uuid...))
+		return nil
+	})
+	for _, uuid := range uuids {
+		if err = destroyGif(tx, uuid); err != nil {
+			return err
+		}
+	}
+	if err = forgetNamespace(tx, ns); err != nil {
+		return err
+	}
+	return moveStats(tx, ns, nil)
+}
+
+func showNamespace(db *bolt.DB, c web.C, w http.ResponseWriter, r *http.Request) {
+	namespace := c.URLParams["namespace"]
+	if !authorized(models.ReadAccess, namespace, c, w, r) {
+		return
+	}
+	var info NamespaceInfo
+	err := db.View(func(tx *bolt.Tx) error {
+		var found bool
+		var err error
+		if info, found, err = readNamespaceInfo(tx, []byte(namespace)); err == nil && !found {
+			return models.RecordNotFound
+		}
+		return err
+	})
+	switch err {
+	case nil:
+		response(http.StatusOK, info, c, w, r)
+	case models.RecordNotFound:
+		notFound(fmt.Sprintf("%s does not exist", namespace), c, w, r)
+	default:
+		errorHandler(err, c, w, r)
+	}
+}
+
+func updateNamespace(db *bolt.DB, c web.C, w http.ResponseWriter, r *http.Request) {
+	namespace := c.URLParams["namespace"]
+	if !authorized(models.WriteAccess, namespace, c, w, r) {
+		return
+	}
+	var info NamespaceInfo
+	if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
+		response(http.StatusNotAcceptable, requestError{"Invalid namespace metadata"}, c, w, r)
+		return
+	}
+	if len(info.RandomStrategy) > 0 && !validStrategy(info.RandomStrategy) {
+		response(
+			http.StatusNotAcceptable,
+			requestError{fmt.Sprintf("random-strategy must be %s, %s or %s", strategyUniform, strategyWeighted, strategyFresh)},
+			c, w, r,
+		)
+		return
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(root)).Bucket([]byte(namespace)) == nil {
+			return models.RecordNotFound
+		}
+		return writeNamespaceInfo(tx, []byte(namespace), info)
+	})
+	info.Name = namespace
+	switch err {
+	case nil:
+		response(http.StatusOK, info, c, w, r)
+	case models.RecordNotFound:
+		notFound(fmt.Sprintf("%s does not exist", namespace), c, w, r)
+	default:
+		errorHandler(err, c, w, r)
+	}
+}
+
+// moveNamespace handles both renames and merges, which take the target
+// namespace in the request body as {"name": ...} and {"into": ...}.
+func moveNamespace(db *bolt.DB, c web.C, w http.ResponseWriter, r *http.Request) {
+	namespace := c.URLParams["namespace"]
+	var params struct {
+		Name string `json:"name"`
+		Into string `json:"into"`
+	}
+	json.NewDecoder(r.Body).Decode(&params)
+	merge := strings.HasSuffix(r.URL.Path, "/merge")
+	target := params.Name
+	if merge {
+		target = params.Into
+	}
+	if !validNamespace(target) || target == namespace {
+		response(
+			http.StatusNotAcceptable,
+			requestError{"The target namespace must be a different name. " + invalidNamespaceMessage},
+			c, w, r,
+		)
+		return
+	}
+	if !authorized(models.WriteAccess, namespace, c, w, r) || !authorized(models.WriteAccess, target, c, w, r) {
+		return
+	}
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		if merge {
+			return mergeNamespace(tx, []byte(namespace), []byte(target))
+		}
+		return renameNamespace(tx, []byte(namespace), []byte(target))
+	})
+	if conflict, ok := err.(namespaceConflict); ok {
+		response(http.StatusConflict, requestError{conflict.Error()}, c, w, r)
+		return
+	}
+
+	var info NamespaceInfo
+	if err == nil {
+		err = db.View(func(tx *bolt.Tx) error {
+			var err error
+			info, _, err = readNamespaceInfo(tx, []byte(target))
+			return err
+		})
+	}
+	switch {
+	case err == nil:
+		response(http.StatusOK, info, c, w, r)
+	case err == models.RecordNotFound && merge:
+		notFound(fmt.Sprintf("%s and %s must both exist", namespace, target), c, w, r)
+	case err == models.RecordNotFound:
+		notFound(fmt.Sprintf("%s does not exist", namespace), c, w, r)
+	default:
+		errorHandler(err, c, w, r)
+	}
+}
+
+func destroyNamespace(db *bolt.DB, c web.C, w http.ResponseWriter, r *http.Request) {
+	namespace := c.URLParams["namespace"]
+	if !authorized(models.WriteAccess, namespace, c, w, r) {
+		return
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		return deleteNamespace(tx, []byte(namespace))
+	})
+	switch err {
+	case nil:
+		response(http.StatusOK, struct{}{}, c, w, r)
+	case models.RecordNotFound:
+		notFound(fmt.Sprintf("%s does not exist", namespace), c, w, r)
+	default:
+		errorHandler(err, c, w, r)
+	}
+}
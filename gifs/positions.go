@@ -0,0 +1,172 @@
+package gifs
+
+import (
+	"encoding/binary"
+
+	"github.com/boltdb/bolt"
+)
+
+// The positions bucket keeps a dense index of every namespace so a random
+// GIF can be picked with a single lookup. Each namespace has a slots bucket
+// mapping positions 0..n-1 to uuids, and an offsets bucket mapping uuids
+// back to their position. Removing a GIF moves the last slot into the hole
+// it leaves, so positions stay contiguous.
+const positionsBucketName string = "giftd-positions"
+const slotsBucketName string = "slots"
+const offsetsBucketName string = "offsets"
+
+func encodePosition(position int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(position))
+	return key
+}
+
+func decodePosition(key []byte) int {
+	return int(binary.BigEndian.Uint64(key))
+}
+
+func positionsFor(tx *bolt.Tx, ns []byte) (slots, offsets *bolt.Bucket) {
+	positions := tx.Bucket([]byte(positionsBucketName))
+	if positions == nil || positions.Bucket(ns) == nil {
+		return nil, nil
+	}
+	positionsForNamespace := positions.Bucket(ns)
+	return positionsForNamespace.Bucket([]byte(slotsBucketName)), positionsForNamespace.Bucket([]byte(offsetsBucketName))
+}
+
+// positionCount returns the number of GIFs indexed for ns, or -1 if the
+// namespace has not been indexed yet.
+func positionCount(tx *bolt.Tx, ns []byte) int {
+	slots, _ := positionsFor(tx, ns)
+	if slots == nil {
+		return -1
+	}
+	last, _ := slots.Cursor().Last()
+	if last == nil {
+		return 0
+	}
+	return decodePosition(last) + 1
+}
+
+func gifAtPosition(tx *bolt.Tx, ns []byte, position int) []byte {
+	slots, _ := positionsFor(tx, ns)
+	if slots == nil {
+		return nil
+	}
+	return slots.Get(encodePosition(position))
+}
+
+// addPosition indexes uuid, which must already have been stored in ns. A
+// namespace that has never been indexed is indexed in full instead. A uuid
+// that is already indexed is only weighed again.
+func addPosition(tx *bolt.Tx, ns, uuid []byte) error {
+	slots, offsets := positionsFor(tx, ns)
+	if slots == nil {
+		return indexNamespace(tx, ns)
+	}
+	if offsets.Get(uuid) != nil {
+		return reweighGif(tx, ns, uuid)
+	}
+	position := positionCount(tx, ns)
+	key := encodePosition(position)
+	if err := slots.Put(key, uuid); err != nil {
+		return err
+	}
+	if err := offsets.Put(uuid, key); err != nil {
+		return err
+	}
+	return weighGif(tx, ns, uuid, position)
+}
+
+func removePosition(tx *bolt.Tx, ns, uuid []byte) error {
+	slots, offsets := positionsFor(tx, ns)
+	if slots == nil {
+		return nil
+	}
+	key := offsets.Get(uuid)
+	if key == nil {
+		return nil
+	}
+	key = append([]byte{}, key...)
+	lastKey, lastUUID := slots.Cursor().Last()
+	lastKey = append([]byte{}, lastKey...)
+	lastUUID = append([]byte{}, lastUUID...)
+
+	if err := offsets.Delete(uuid); err != nil {
+		return err
+	}
+	if err := slots.Delete(lastKey); err != nil {
+		return err
+	}
+	if err := removeWeight(tx, ns, decodePosition(key)); err != nil {
+		return err
+	}
+	if decodePosition(key) == decodePosition(lastKey) {
+		return nil
+	}
+	if err := slots.Put(key, lastUUID); err != nil {
+		return err
+	}
+	return offsets.Put(lastUUID, key)
+}
+
+func dropPositions(tx *bolt.Tx, ns []byte) error {
+	if err := dropWeights(tx, ns); err != nil {
+		return err
+	}
+	positions := tx.Bucket([]byte(positionsBucketName))
+	if positions == nil || positions.Bucket(ns) == nil {
+		return nil
+	}
+	return positions.DeleteBucket(ns)
+}
+
+func indexNamespace(tx *bolt.Tx, ns []byte) error {
+	bucketForNamespace := tx.Bucket([]byte(root)).Bucket(ns)
+	if bucketForNamespace == nil {
+		return nil
+	}
+	if err := dropWeights(tx, ns); err != nil {
+		return err
+	}
+	positions, err := tx.CreateBucketIfNotExists([]byte(positionsBucketName))
+	if err != nil {
+		return err
+	}
+	positionsForNamespace, err := positions.CreateBucketIfNotExists(ns)
+	if err != nil {
+		return err
+	}
+	slots, err := positionsForNamespace.CreateBucketIfNotExists([]byte(slotsBucketName))
+	if err != nil {
+		return err
+	}
+	offsets, err := positionsForNamespace.CreateBucketIfNotExists([]byte(offsetsBucketName))
+	if err != nil {
+		return err
+	}
+	position := 0
+	cursor := bucketForNamespace.Cursor()
+	for uuid, _ := cursor.First(); uuid != nil; uuid, _ = cursor.Next() {
+		key := encodePosition(position)
+		if err = slots.Put(key, uuid); err != nil {
+			return err
+		}
+		if err = offsets.Put(uuid, key); err != nil {
+			return err
+		}
+		position++
+	}
+	return nil
+}
+
+// indexPositions builds the positional index for a namespace written before
+// the index existed.
+func indexPositions(db *bolt.DB, ns []byte) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		if positionCount(tx, ns) >= 0 {
+			return nil
+		}
+		return indexNamespace(tx, ns)
+	})
+}
@@ -0,0 +1,125 @@
+package gifs
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// checkPositions verifies that the index for ns holds exactly the GIFs in
+// the namespace at contiguous positions, with offsets pointing back at them.
+func checkPositions(t *testing.T, tx *bolt.Tx, ns []byte) {
+	t.Helper()
+	stored := []string{}
+	tx.Bucket([]byte(root)).Bucket(ns).ForEach(func(uuid, _ []byte) error {
+		stored = append(stored, string(uuid))
+		return nil
+	})
+	if count := positionCount(tx, ns); count != len(stored) {
+		t.Fatalf("positionCount = %d, want %d", count, len(stored))
+	}
+	_, offsets := positionsFor(tx, ns)
+	indexed := []string{}
+	for position := 0; position < len(stored); position++ {
+		uuid := gifAtPosition(tx, ns, position)
+		if uuid == nil {
+			t.Fatalf("position %d is empty", position)
+		}
+		if offset := offsets.Get(uuid); offset == nil || decodePosition(offset) != position {
+			t.Fatalf("offset of %s does not point at position %d", uuid, position)
+		}
+		indexed = append(indexed, string(uuid))
+	}
+	sort.Strings(indexed)
+	if fmt.Sprint(indexed) != fmt.Sprint(stored) {
+		t.Fatalf("indexed %v, want %v", indexed, stored)
+	}
+}
+
+func TestRemovePositionKeepsIndexDense(t *testing.T) {
+	db := openTestDB(t)
+	ns := []byte("reactions")
+	for i := 0; i < 8; i++ {
+		uuid := []byte(fmt.Sprintf("gif-%d", i))
+		if _, _, err := storeGif(db, ns, uuid, encodeGif(t, 10+i, 10, 1), Metadata{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Remove from the middle, the end and the start of the index.
+	for _, uuid := range []string{"gif-3", "gif-7", "gif-0", "gif-5"} {
+		err := db.Update(func(tx *bolt.Tx) error {
+			if err := removeFromNamespace(tx, ns, []byte(uuid)); err != nil {
+				return err
+			}
+			checkPositions(t, tx, ns)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAddPositionIndexesLegacyNamespace(t *testing.T) {
+	db := openTestDB(t)
+	ns := []byte("reactions")
+	for i := 0; i < 3; i++ {
+		uuid := []byte(fmt.Sprintf("gif-%d", i))
+		if _, _, err := storeGif(db, ns, uuid, encodeGif(t, 10+i, 10, 1), Metadata{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		if err := dropPositions(tx, ns); err != nil {
+			return err
+		}
+		if count := positionCount(tx, ns); count != -1 {
+			t.Fatalf("positionCount after dropping the index = %d, want -1", count)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err = storeGif(db, ns, []byte("gif-3"), encodeGif(t, 20, 10, 1), Metadata{}); err != nil {
+		t.Fatal(err)
+	}
+	db.View(func(tx *bolt.Tx) error {
+		checkPositions(t, tx, ns)
+		return nil
+	})
+}
+
+func TestFindRandomGifs(t *testing.T) {
+	db := openTestDB(t)
+	ns := []byte("reactions")
+	for i := 0; i < 5; i++ {
+		uuid := []byte(fmt.Sprintf("gif-%d", i))
+		if _, _, err := storeGif(db, ns, uuid, encodeGif(t, 10+i, 10, 1), Metadata{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rng := rand.New(rand.NewSource(1))
+	for _, num := range []int{1, 3, 5, 10} {
+		uuids, err := findRandomGifs(db, ns, num, rng)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := num
+		if want > 5 {
+			want = 5
+		}
+		seen := map[string]bool{}
+		for _, uuid := range uuids {
+			seen[uuid] = true
+		}
+		if len(uuids) != want || len(seen) != want {
+			t.Errorf("findRandomGifs(%d) = %v, want %d distinct GIFs", num, uuids, want)
+		}
+	}
+}
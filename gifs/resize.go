@@ -0,0 +1,215 @@
+package gifs
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/gif"
+	"net/http"
+	"strconv"
+
+	"github.com/boltdb/bolt"
+	"github.com/zenazn/goji/web"
+)
+
+const variantsBucketName string = "giftd-variants"
+const defaultMaxResize int = 512
+const fitContain string = "contain"
+const fitStretch string = "stretch"
+
+var defaultResizeSizes []int = []int{64, 128, 256, 512}
+
+type resizeRequest struct {
+	Width  int
+	Height int
+	Fit    string
+}
+
+func (rr resizeRequest) requested() bool {
+	return rr.Width > 0 || rr.Height > 0
+}
+
+// dimensions works out the size of the variant for a GIF that is width x
+// height.
+func (rr resizeRequest) dimensions(width, height int) (int, int) {
+	switch {
+	case rr.Fit == fitStretch && rr.Width > 0 && rr.Height > 0:
+		return rr.Width, rr.Height
+	case rr.Width > 0 && rr.Height > 0:
+		if width*rr.Height > height*rr.Width {
+			return rr.Width, imax(1, height*rr.Width/width)
+		}
+		return imax(1, width*rr.Height/height), rr.Height
+	case rr.Width > 0:
+		return rr.Width, imax(1, height*rr.Width/width)
+	default:
+		return imax(1, width*rr.Height/height), rr.Height
+	}
+}
+
+func intsSetting(c web.C, key string, fallback []int) []int {
+	values, ok := c.Env[key].([]interface{})
+	if !ok {
+		return fallback
+	}
+	ints := []int{}
+	for _, value := range values {
+		if n, ok := value.(float64); ok && n > 0 {
+			ints = append(ints, int(n))
+		}
+	}
+	return ints
+}
+
+func parseResize(c web.C, r *http.Request) (resizeRequest, error) {
+	var rr resizeRequest
+	allowed := intsSetting(c, "resize-sizes", defaultResizeSizes)
+	max := intSetting(c, "resize-max-size", defaultMaxResize)
+	parse := func(name string) (int, error) {
+		param := r.URL.Query().Get(name)
+		if len(param) <= 0 {
+			return 0, nil
+		}
+		n, err := strconv.Atoi(param)
+		if err != nil || n <= 0 || n > max {
+			return 0, fmt.Errorf("%s must be between 1 and %d", name, max)
+		}
+		for _, size := range allowed {
+			if n == size {
+				return n, nil
+			}
+		}
+		return 0, fmt.Errorf("%s must be one of %v", name, allowed)
+	}
+
+	var err error
+	if rr.Width, err = parse("width"); err != nil {
+		return rr, err
+	}
+	if rr.Height, err = parse("height"); err != nil {
+		return rr, err
+	}
+	switch rr.Fit = r.URL.Query().Get("fit"); rr.Fit {
+	case "":
+		rr.Fit = fitContain
+	case fitContain, fitStretch:
+	default:
+		return rr, fmt.Errorf("fit must be %s or %s", fitContain, fitStretch)
+	}
+	return rr, nil
+}
+
+func scaleRect(rect image.Rectangle, fromW, fromH, toW, toH int) image.Rectangle {
+	scaled := image.Rect(
+		rect.Min.X*toW/fromW, rect.Min.Y*toH/fromH,
+		rect.Max.X*toW/fromW, rect.Max.Y*toH/fromH,
+	)
+	if scaled.Dx() <= 0 {
+		scaled.Max.X = scaled.Min.X + 1
+	}
+	if scaled.Dy() <= 0 {
+		scaled.Max.Y = scaled.Min.Y + 1
+	}
+	return scaled
+}
+
+// scalePaletted nearest-neighbour scales a frame so that palette indices,
+// including transparency, are carried over untouched.
+func scalePaletted(frame *image.Paletted, fromW, fromH, toW, toH int) *image.Paletted {
+	bounds := frame.Bounds()
+	scaled := image.NewPaletted(scaleRect(bounds, fromW, fromH, toW, toH), frame.Palette)
+	for y := scaled.Rect.Min.Y; y < scaled.Rect.Max.Y; y++ {
+		sy := y * fromH / toH
+		if sy < bounds.Min.Y {
+			sy = bounds.Min.Y
+		} else if sy >= bounds.Max.Y {
+			sy = bounds.Max.Y - 1
+		}
+		for x := scaled.Rect.Min.X; x < scaled.Rect.Max.X; x++ {
+			sx := x * fromW / toW
+			if sx < bounds.Min.X {
+				sx = bounds.Min.X
+			} else if sx >= bounds.Max.X {
+				sx = bounds.Max.X - 1
+			}
+			scaled.SetColorIndex(x, y, frame.ColorIndexAt(sx, sy))
+		}
+	}
+	return scaled
+}
+
+// resizeGif scales every frame of content, keeping delays, disposal and loop
+// behaviour intact.
+func resizeGif(content []byte, rr resizeRequest) ([]byte, error) {
+	g, err := gif.DecodeAll(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	fromW, fromH := g.Config.Width, g.Config.Height
+	toW, toH := rr.dimensions(fromW, fromH)
+	for i, frame := range g.Image {
+		g.Image[i] = scalePaletted(frame, fromW, fromH, toW, toH)
+	}
+	g.Config.Width, g.Config.Height = toW, toH
+
+	var buff bytes.Buffer
+	if err = gif.EncodeAll(&buff, g); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+func variantKey(tx *bolt.Tx, uuid []byte, rr resizeRequest) []byte {
+	hash := derivativeKey(tx, uuid)
+	if hash == nil {
+		return nil
+	}
+	return []byte(fmt.Sprintf("%s/%dx%d/%s", hash, rr.Width, rr.Height, rr.Fit))
+}
+
+func deleteVariants(tx *bolt.Tx, hash []byte) error {
+	variants := tx.Bucket([]byte(variantsBucketName))
+	if variants == nil || hash == nil {
+		return nil
+	}
+	prefix := append(append([]byte{}, hash...), '/')
+	cursor := variants.Cursor()
+	for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Seek(prefix) {
+		if err := variants.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureVariant returns the cached resized copy of uuid, encoding and storing
+// it first if needed.
+func ensureVariant(db *bolt.DB, uuid, content []byte, rr resizeRequest) ([]byte, error) {
+	var key, variant []byte
+	err := db.View(func(tx *bolt.Tx) error {
+		if key = variantKey(tx, uuid, rr); key == nil {
+			return fmt.Errorf("ensureVariant: %s has no content", uuid)
+		}
+		if variants := tx.Bucket([]byte(variantsBucketName)); variants != nil {
+			if cached := variants.Get(key); cached != nil {
+				variant = append([]byte{}, cached...)
+			}
+		}
+		return nil
+	})
+	if err != nil || variant != nil {
+		return variant, err
+	}
+
+	if variant, err = resizeGif(content, rr); err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		variants, err := tx.CreateBucketIfNotExists([]byte(variantsBucketName))
+		if err != nil {
+			return err
+		}
+		return variants.Put(key, variant)
+	})
+	return variant, err
+}
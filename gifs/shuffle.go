@@ -0,0 +1,189 @@
+package gifs
+
+import (
+	"encoding/binary"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/csaunders/giftd/middleware"
+	"github.com/csaunders/giftd/models"
+	"github.com/zenazn/goji/web"
+)
+
+// Shuffle bags remember which GIFs a client has already been served from a
+// namespace so that nothing repeats until every GIF has been seen. Each
+// namespace has a clients bucket holding each client's bag and an expiry
+// bucket keyed by expiry time so stale bags can be swept in order.
+const bagsBucketName string = "giftd-bags"
+const bagClientsBucketName string = "clients"
+const bagExpiryBucketName string = "expiry"
+const defaultBagTTLHours int = 24
+
+const clientHeader string = "X-Giftd-Client"
+const clientCookie string = "giftd-client"
+
+type shuffleBag struct {
+	Served    []string  `json:"served"`
+	ExpiresAt time.Time `json:"expires-at"`
+}
+
+func shuffleRequested(r *http.Request) bool {
+	shuffle, _ := strconv.ParseBool(r.URL.Query().Get("shuffle"))
+	return shuffle
+}
+
+// clientIdentity identifies who a shuffle bag belongs to. Callers sharing an
+// account can tell themselves apart with an opaque header or cookie.
+func clientIdentity(c web.C, r *http.Request) string {
+	if client := r.Header.Get(clientHeader); len(client) > 0 {
+		return "client:" + client
+	}
+	if cookie, err := r.Cookie(clientCookie); err == nil && len(cookie.Value) > 0 {
+		return "client:" + cookie.Value
+	}
+	if account, ok := c.Env[middleware.AccountDetails].(models.Account); ok && len(account.Id) > 0 {
+		return "account:" + account.Id
+	}
+	return reporterIdentity(c, r)
+}
+
+func expiryKey(expiresAt time.Time, identity string) []byte {
+	key := make([]byte, 8, 8+len(identity))
+	binary.BigEndian.PutUint64(key, uint64(expiresAt.Unix()))
+	return append(key, identity...)
+}
+
+func bagsFor(tx *bolt.Tx, namespace []byte) (clients, expiry *bolt.Bucket, err error) {
+	bags, err := tx.CreateBucketIfNotExists([]byte(bagsBucketName))
+	if err != nil {
+		return nil, nil, err
+	}
+	bagsForNamespace, err := bags.CreateBucketIfNotExists(namespace)
+	if err != nil {
+		return nil, nil, err
+	}
+	if clients, err = bagsForNamespace.CreateBucketIfNotExists([]byte(bagClientsBucketName)); err != nil {
+		return nil, nil, err
+	}
+	expiry, err = bagsForNamespace.CreateBucketIfNotExists([]byte(bagExpiryBucketName))
+	return clients, expiry, err
+}
+
+// sweepBags deletes every bag in the namespace that expired before now.
+func sweepBags(clients, expiry *bolt.Bucket, now time.Time) error {
+	cursor := expiry.Cursor()
+	for key, _ := cursor.First(); key != nil; key, _ = cursor.First() {
+		if int64(binary.BigEndian.Uint64(key[:8])) >= now.Unix() {
+			return nil
+		}
+		identity := string(key[8:])
+		if err := expiry.Delete(key); err != nil {
+			return err
+		}
+		if err := clients.Delete([]byte(identity)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func dropBags(tx *bolt.Tx, namespace []byte) error {
+	bags := tx.Bucket([]byte(bagsBucketName))
+	if bags == nil || bags.Bucket(namespace) == nil {
+		return nil
+	}
+	return bags.DeleteBucket(namespace)
+}
+
+// sampleFrom picks up to num of candidates according to q.
+func (q randomQuery) sampleFrom(bucketForNamespace *bolt.Bucket, candidates []string, num int) ([]string, error) {
+	if q.Weigh != nil {
+		return weightedSample(bucketForNamespace, num, candidates, q.Weigh, q.Rand)
+	}
+	uuids := []string{}
+	for _, i := range q.Rand.Perm(len(candidates)) {
+		if len(uuids) >= num {
+			break
+		}
+		uuids = append(uuids, candidates[i])
+	}
+	return uuids, nil
+}
+
+func without(uuids []string, excluded []string) []string {
+	skip := map[string]bool{}
+	for _, uuid := range excluded {
+		skip[uuid] = true
+	}
+	remaining := []string{}
+	for _, uuid := range uuids {
+		if !skip[uuid] {
+			remaining = append(remaining, uuid)
+		}
+	}
+	return remaining
+}
+
+// pickFromBag picks num GIFs the client identified by identity has not yet
+// been served. Once the bag runs out it is refilled, avoiding the GIFs
+// picked in the same request.
+func (q randomQuery) pickFromBag(db *bolt.DB, namespace []byte, num int, identity string, ttl time.Duration) ([]string, error) {
+	var picked []string
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucketForNamespace := tx.Bucket([]byte(root)).Bucket(namespace)
+		if bucketForNamespace == nil {
+			return models.RecordNotFound
+		}
+		candidates := []string{}
+		if len(q.Tags) > 0 {
+			for _, uuid := range taggedGifs(tx, q.Tags, q.Mode) {
+				if bucketForNamespace.Get([]byte(uuid)) != nil {
+					candidates = append(candidates, uuid)
+				}
+			}
+		} else {
+			bucketForNamespace.ForEach(func(uuid, _ []byte) error {
+				candidates = append(candidates, string(uuid))
+				return nil
+			})
+		}
+
+		clients, expiry, err := bagsFor(tx, namespace)
+		if err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		if err = sweepBags(clients, expiry, now); err != nil {
+			return err
+		}
+		var bag shuffleBag
+		if err = models.Load(clients, identity, &bag); err == nil {
+			if err = expiry.Delete(expiryKey(bag.ExpiresAt, identity)); err != nil {
+				return err
+			}
+		} else if err != models.RecordNotFound {
+			return err
+		}
+
+		if picked, err = q.sampleFrom(bucketForNamespace, without(candidates, bag.Served), num); err != nil {
+			return err
+		}
+		if len(picked) < num {
+			bag.Served = []string{}
+			refill, err := q.sampleFrom(bucketForNamespace, without(candidates, picked), num-len(picked))
+			if err != nil {
+				return err
+			}
+			picked = append(picked, refill...)
+		}
+		bag.Served = append(bag.Served, picked...)
+		bag.ExpiresAt = now.Add(ttl)
+		if err = models.Save(clients, identity, bag); err != nil {
+			return err
+		}
+		return expiry.Put(expiryKey(bag.ExpiresAt, identity), []byte{})
+	})
+	return picked, err
+}
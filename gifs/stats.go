@@ -0,0 +1,351 @@
+package gifs
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/csaunders/giftd/middleware"
+	"github.com/csaunders/giftd/models"
+	"github.com/zenazn/goji/web"
+)
+
+// Usage is counted per day in three flat buckets: per GIF keyed by
+// "uuid/day", per namespace keyed by "namespace/day", and per GIF within a
+// namespace keyed by "namespace/day/uuid" so the most used GIFs for a period
+// can be found by seeking to each day.
+const statsBucketName string = "giftd-stats"
+const gifStatsBucketName string = "gifs"
+const namespaceStatsBucketName string = "namespaces"
+const dailyStatsBucketName string = "daily"
+
+const statsDateFormat string = "2006-01-02"
+const defaultStatsFlushSeconds int = 10
+const defaultStatsPeriod int = 30
+const maxStatsPeriod int = 365
+const defaultTopLimit int = 10
+
+// statCounts is the number of times a GIF was served directly and picked by
+// the random endpoints.
+type statCounts struct {
+	Views int64 `json:"views"`
+	Picks int64 `json:"picks"`
+}
+
+func (s *statCounts) add(other statCounts) {
+	s.Views += other.Views
+	s.Picks += other.Picks
+}
+
+func (s statCounts) total() int64 {
+	return s.Views + s.Picks
+}
+
+type statPoint struct {
+	Day string `json:"day"`
+	statCounts
+}
+
+type statKey struct {
+	Namespace string
+	UUID      string
+	Day       string
+}
+
+// Counts are held in memory and written to each datastore in a single
+// transaction every stats-flush-seconds, so anything counted in the moments
+// before giftd stops is lost.
+var pendingStats map[string]map[statKey]statCounts = map[string]map[statKey]statCounts{}
+var pendingStatsMutex sync.Mutex
+var statsFlusherStarted sync.Once
+
+func countUsage(c web.C, db *bolt.DB, namespace string, uuids []string, counts statCounts) {
+	statsFlusherStarted.Do(func() {
+		interval := time.Duration(intSetting(c, "stats-flush-seconds", defaultStatsFlushSeconds)) * time.Second
+		go statsFlusher(interval)
+	})
+	day := time.Now().UTC().Format(statsDateFormat)
+	pendingStatsMutex.Lock()
+	defer pendingStatsMutex.Unlock()
+	datastore := db.Path()
+	if pendingStats[datastore] == nil {
+		pendingStats[datastore] = map[statKey]statCounts{}
+	}
+	for _, uuid := range uuids {
+		key := statKey{namespace, uuid, day}
+		current := pendingStats[datastore][key]
+		current.add(counts)
+		pendingStats[datastore][key] = current
+	}
+}
+
+// countView counts a GIF being served, ignoring HEAD requests and range
+// requests that resume part way through.
+func countView(c web.C, db *bolt.DB, r *http.Request, namespace, uuid string) {
+	if r.Method == "HEAD" {
+		return
+	}
+	if ranges := r.Header.Get("Range"); len(ranges) > 0 && !strings.HasPrefix(ranges, "bytes=0-") {
+		return
+	}
+	countUsage(c, db, namespace, []string{uuid}, statCounts{Views: 1})
+}
+
+func countPicks(c web.C, db *bolt.DB, namespace string, uuids []string) {
+	countUsage(c, db, namespace, uuids, statCounts{Picks: 1})
+}
+
+func statsFlusher(interval time.Duration) {
+	for range time.Tick(interval) {
+		pendingStatsMutex.Lock()
+		flushing := pendingStats
+		pendingStats = map[string]map[statKey]statCounts{}
+		pendingStatsMutex.Unlock()
+
+		for datastore, counts := range flushing {
+			err := middleware.WithDatastore(datastore, func(db *bolt.DB) error {
+				return writeStats(db, counts)
+			})
+			if err != nil {
+				log.Println("statsFlusher:", datastore, err)
+			}
+		}
+	}
+}
+
+func addStats(b *bolt.Bucket, key string, counts statCounts) error {
+	var current statCounts
+	if data := b.Get([]byte(key)); data != nil {
+		if err := json.Unmarshal(data, &current); err != nil {
+			return err
+		}
+	}
+	current.add(counts)
+	data, err := json.Marshal(current)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), data)
+}
+
+func writeStats(db *bolt.DB, counts map[statKey]statCounts) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		stats, err := tx.CreateBucketIfNotExists([]byte(statsBucketName))
+		if err != nil {
+			return err
+		}
+		buckets := map[string]*bolt.Bucket{}
+		for _, name := range []string{gifStatsBucketName, namespaceStatsBucketName, dailyStatsBucketName} {
+			if buckets[name], err = stats.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		for key, count := range counts {
+			if err = addStats(buckets[gifStatsBucketName], key.UUID+"/"+key.Day, count); err != nil {
+				return err
+			}
+			if err = addStats(buckets[namespaceStatsBucketName], key.Namespace+"/"+key.Day, count); err != nil {
+				return err
+			}
+			if err = addStats(buckets[dailyStatsBucketName], key.Namespace+"/"+key.Day+"/"+key.UUID, count); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func statsBucket(tx *bolt.Tx, name string) *bolt.Bucket {
+	stats := tx.Bucket([]byte(statsBucketName))
+	if stats == nil {
+		return nil
+	}
+	return stats.Bucket([]byte(name))
+}
+
+// parsePeriod reads ?period= as a number of days such as "7d", returning the
+// days it covers from oldest to newest.
+func parsePeriod(r *http.Request, now time.Time) ([]string, error) {
+	days := defaultStatsPeriod
+	if raw := r.URL.Query().Get("period"); len(raw) > 0 {
+		n, err := strconv.Atoi(strings.TrimSuffix(raw, "d"))
+		if err != nil || n <= 0 || n > maxStatsPeriod {
+			return nil, fmt.Errorf("period must be between 1d and %dd", maxStatsPeriod)
+		}
+		days = n
+	}
+	period := make([]string, days)
+	for i := range period {
+		period[i] = now.UTC().AddDate(0, 0, i-days+1).Format(statsDateFormat)
+	}
+	return period, nil
+}
+
+func readSeries(b *bolt.Bucket, prefix string, period []string) ([]statPoint, statCounts, error) {
+	series := make([]statPoint, len(period))
+	var totals statCounts
+	for i, day := range period {
+		series[i].Day = day
+		if b == nil {
+			continue
+		}
+		if data := b.Get([]byte(prefix + "/" + day)); data != nil {
+			if err := json.Unmarshal(data, &series[i].statCounts); err != nil {
+				return nil, totals, err
+			}
+		}
+		totals.add(series[i].statCounts)
+	}
+	return series, totals, nil
+}
+
+func showStats(db *bolt.DB, c web.C, w http.ResponseWriter, r *http.Request) {
+	namespace := c.URLParams["namespace"]
+	if !authorized(models.ReadAccess, namespace, c, w, r) {
+		return
+	}
+	period, err := parsePeriod(r, time.Now())
+	if err != nil {
+		response(http.StatusNotAcceptable, requestError{err.Error()}, c, w, r)
+		return
+	}
+	var body struct {
+		Namespace string       `json:"namespace"`
+		Totals    statCounts   `json:"totals"`
+		Series    []statPoint  `json:"series"`
+		Gifs      []gifSummary `json:"gifs"`
+	}
+	body.Namespace = namespace
+	err = db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(root)).Bucket([]byte(namespace)) == nil {
+			return models.RecordNotFound
+		}
+		var err error
+		body.Series, body.Totals, err = readSeries(statsBucket(tx, namespaceStatsBucketName), namespace, period)
+		if err != nil {
+			return err
+		}
+		body.Gifs, err = topGifs(tx, []string{namespace}, period, intSetting(c, "stats-top-limit", defaultTopLimit))
+		return err
+	})
+	switch err {
+	case nil:
+		response(http.StatusOK, body, c, w, r)
+	case models.RecordNotFound:
+		notFound(fmt.Sprintf("%s does not exist", namespace), c, w, r)
+	default:
+		errorHandler(err, c, w, r)
+	}
+}
+
+type gifSummary struct {
+	UUID      string      `json:"uuid"`
+	Namespace string      `json:"namespace"`
+	Totals    statCounts  `json:"totals"`
+	Series    []statPoint `json:"series"`
+}
+
+// topGifs returns the limit most used GIFs across namespaces over period,
+// skipping any that have since been removed.
+func topGifs(tx *bolt.Tx, namespaces []string, period []string, limit int) ([]gifSummary, error) {
+	summaries := []gifSummary{}
+	daily := statsBucket(tx, dailyStatsBucketName)
+	if daily == nil {
+		return summaries, nil
+	}
+	totals := map[statKey]statCounts{}
+	for _, namespace := range namespaces {
+		for _, day := range period {
+			prefix := []byte(namespace + "/" + day + "/")
+			cursor := daily.Cursor()
+			for k, v := cursor.Seek(prefix); k != nil && strings.HasPrefix(string(k), string(prefix)); k, v = cursor.Next() {
+				var counts statCounts
+				if err := json.Unmarshal(v, &counts); err != nil {
+					return nil, err
+				}
+				key := statKey{Namespace: namespace, UUID: string(k[len(prefix):])}
+				current := totals[key]
+				current.add(counts)
+				totals[key] = current
+			}
+		}
+	}
+
+	for key, counts := range totals {
+		if !inNamespace(tx, []byte(key.Namespace), []byte(key.UUID)) {
+			continue
+		}
+		summaries = append(summaries, gifSummary{UUID: key.UUID, Namespace: key.Namespace, Totals: counts})
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].Totals.total() == summaries[j].Totals.total() {
+			return summaries[i].UUID < summaries[j].UUID
+		}
+		return summaries[i].Totals.total() > summaries[j].Totals.total()
+	})
+	if len(summaries) > limit {
+		summaries = summaries[:limit]
+	}
+	for i := range summaries {
+		series, _, err := readSeries(statsBucket(tx, gifStatsBucketName), summaries[i].UUID, period)
+		if err != nil {
+			return nil, err
+		}
+		summaries[i].Series = series
+	}
+	return summaries, nil
+}
+
+func showTopGifs(db *bolt.DB, c web.C, w http.ResponseWriter, r *http.Request) {
+	period, err := parsePeriod(r, time.Now())
+	if err != nil {
+		response(http.StatusNotAcceptable, requestError{err.Error()}, c, w, r)
+		return
+	}
+	limit := defaultTopLimit
+	if raw := r.URL.Query().Get("limit"); len(raw) > 0 {
+		if limit, err = strconv.Atoi(raw); err != nil || limit <= 0 || limit > maxPageSize {
+			response(http.StatusNotAcceptable, requestError{fmt.Sprintf("limit must be between 1 and %d", maxPageSize)}, c, w, r)
+			return
+		}
+	}
+
+	namespace := r.URL.Query().Get("namespace")
+	if len(namespace) > 0 && !authorized(models.ReadAccess, namespace, c, w, r) {
+		return
+	}
+
+	var body struct {
+		Period []string     `json:"period"`
+		Gifs   []gifSummary `json:"gifs"`
+	}
+	body.Period = period
+	err = db.View(func(tx *bolt.Tx) error {
+		namespaces := []string{}
+		if len(namespace) > 0 {
+			namespaces = append(namespaces, namespace)
+		} else if b := tx.Bucket([]byte(root)).Bucket([]byte(namespacesBucketName)); b != nil {
+			b.ForEach(func(ns, _ []byte) error {
+				if allowed(models.ReadAccess, string(ns), c) {
+					namespaces = append(namespaces, string(ns))
+				}
+				return nil
+			})
+		}
+		var err error
+		body.Gifs, err = topGifs(tx, namespaces, period, limit)
+		return err
+	})
+	if err != nil {
+		errorHandler(err, c, w, r)
+		return
+	}
+	response(http.StatusOK, body, c, w, r)
+}
@@ -0,0 +1,223 @@
+package gifs
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/csaunders/giftd/models"
+	"github.com/zenazn/goji/web"
+)
+
+const tagsBucketName string = "giftd-tags"
+const matchAny string = "any"
+const matchAll string = "all"
+
+func normalizeTags(tags []string) []string {
+	seen := make(map[string]bool)
+	normalized := []string{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if len(tag) > 0 && !seen[tag] {
+			seen[tag] = true
+			normalized = append(normalized, tag)
+		}
+	}
+	sort.Strings(normalized)
+	return normalized
+}
+
+func parseTags(raw string) []string {
+	if len(raw) <= 0 {
+		return []string{}
+	}
+	return normalizeTags(strings.Split(raw, ","))
+}
+
+func matchMode(r *http.Request) (string, error) {
+	switch mode := r.URL.Query().Get("mode"); mode {
+	case "", matchAny:
+		return matchAny, nil
+	case matchAll:
+		return matchAll, nil
+	default:
+		return "", fmt.Errorf("mode must be %s or %s", matchAny, matchAll)
+	}
+}
+
+func indexTags(tx *bolt.Tx, uuid []byte, tags []string) error {
+	if len(tags) <= 0 {
+		return nil
+	}
+	tagsBucket, err := tx.CreateBucketIfNotExists([]byte(tagsBucketName))
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		bucketForTag, err := tagsBucket.CreateBucketIfNotExists([]byte(tag))
+		if err != nil {
+			return err
+		}
+		if err = bucketForTag.Put(uuid, []byte{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func unindexTags(tx *bolt.Tx, uuid []byte, tags []string) error {
+	tagsBucket := tx.Bucket([]byte(tagsBucketName))
+	if tagsBucket == nil {
+		return nil
+	}
+	for _, tag := range tags {
+		bucketForTag := tagsBucket.Bucket([]byte(tag))
+		if bucketForTag == nil {
+			continue
+		}
+		if err := bucketForTag.Delete(uuid); err != nil {
+			return err
+		}
+		if k, _ := bucketForTag.Cursor().First(); k == nil {
+			if err := tagsBucket.DeleteBucket([]byte(tag)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// taggedGifs returns the uuids carrying any or all of tags, in uuid order.
+// Quarantined GIFs are included; callers filter by namespace.
+func taggedGifs(tx *bolt.Tx, tags []string, mode string) []string {
+	matches := []string{}
+	tagsBucket := tx.Bucket([]byte(tagsBucketName))
+	if tagsBucket == nil {
+		return matches
+	}
+	counts := make(map[string]int)
+	for _, tag := range tags {
+		bucketForTag := tagsBucket.Bucket([]byte(tag))
+		if bucketForTag == nil {
+			continue
+		}
+		bucketForTag.ForEach(func(uuid, _ []byte) error {
+			counts[string(uuid)]++
+			return nil
+		})
+	}
+	for uuid, count := range counts {
+		if mode == matchAll && count < len(tags) {
+			continue
+		}
+		matches = append(matches, uuid)
+	}
+	sort.Strings(matches)
+	return matches
+}
+
+func findRandomTaggedGifs(db *bolt.DB, namespace []byte, num int, tags []string, mode string, rng *rand.Rand) ([]string, error) {
+	candidates := []string{}
+	err := db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(root)).Bucket(namespace) == nil {
+			return fmt.Errorf("findRandomTaggedGifs: bucket does not exist")
+		}
+		for _, uuid := range taggedGifs(tx, tags, mode) {
+			if inNamespace(tx, namespace, []byte(uuid)) {
+				candidates = append(candidates, uuid)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return []string{}, err
+	}
+	uuids := []string{}
+	for _, i := range rng.Perm(len(candidates)) {
+		if len(uuids) >= num {
+			break
+		}
+		uuids = append(uuids, candidates[i])
+	}
+	return uuids, nil
+}
+
+func searchGifs(db *bolt.DB, c web.C, w http.ResponseWriter, r *http.Request) {
+	tags := parseTags(r.URL.Query().Get("tags"))
+	mode, err := matchMode(r)
+	if err != nil {
+		response(http.StatusNotAcceptable, requestError{err.Error()}, c, w, r)
+		return
+	} else if len(tags) <= 0 {
+		response(http.StatusNotAcceptable, requestError{"At least one tag is required"}, c, w, r)
+		return
+	}
+
+	uuids := []string{}
+	err = db.View(func(tx *bolt.Tx) error {
+		for _, uuid := range taggedGifs(tx, tags, mode) {
+			if ns := findNamespace(tx, []byte(uuid)); ns != nil && allowed(models.ReadAccess, string(ns), c) {
+				uuids = append(uuids, uuid)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		errorHandler(err, c, w, r)
+		return
+	}
+	response(
+		http.StatusOK,
+		struct {
+			Locations []string `json:"locations"`
+		}{locationsFor(c, uuids)},
+		c, w, r,
+	)
+}
+
+func updateTags(db *bolt.DB, c web.C, w http.ResponseWriter, r *http.Request) {
+	namespace := c.URLParams["namespace"]
+	uuid := c.URLParams["uuid"]
+	if !authorized(models.WriteAccess, namespace, c, w, r) {
+		return
+	}
+	var params struct {
+		Tags []string `json:"tags"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		response(http.StatusNotAcceptable, requestError{"Invalid tags"}, c, w, r)
+		return
+	}
+	tags := normalizeTags(params.Tags)
+
+	var meta Metadata
+	err := db.Update(func(tx *bolt.Tx) error {
+		if !inNamespace(tx, []byte(namespace), []byte(uuid)) {
+			return models.RecordNotFound
+		}
+		var err error
+		if meta, _, err = readMetadata(tx, []byte(uuid)); err != nil {
+			return err
+		}
+		if err = unindexTags(tx, []byte(uuid), meta.Tags); err != nil {
+			return err
+		}
+		meta.Tags = tags
+		if err = indexTags(tx, []byte(uuid), meta.Tags); err != nil {
+			return err
+		}
+		return writeMetadata(tx, []byte(uuid), meta)
+	})
+	switch err {
+	case nil:
+		response(http.StatusOK, meta, c, w, r)
+	case models.RecordNotFound:
+		notFound(fmt.Sprintf("%s does not exist in %s", uuid, namespace), c, w, r)
+	default:
+		errorHandler(err, c, w, r)
+	}
+}
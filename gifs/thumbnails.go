@@ -0,0 +1,167 @@
+package gifs
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+
+	"github.com/boltdb/bolt"
+	"github.com/zenazn/goji/web"
+)
+
+const thumbnailsBucketName string = "giftd-thumbnails"
+const defaultThumbnailSize int = 160
+
+// fitWithin returns the largest dimensions no bigger than max on either side
+// that preserve the aspect ratio of width x height.
+func fitWithin(width, height, max int) (int, int) {
+	if width <= max && height <= max {
+		return width, height
+	}
+	if width >= height {
+		return max, imax(1, height*max/width)
+	}
+	return imax(1, width*max/height), max
+}
+
+func imax(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// scaleImage box-filters src down (or nearest-neighbours it up) to width x
+// height.
+func scaleImage(src image.Image, width, height int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	bounds := src.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*srcH/height
+		y1 := imax(y0+1, bounds.Min.Y+(y+1)*srcH/height)
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*srcW/width
+			x1 := imax(x0+1, bounds.Min.X+(x+1)*srcW/width)
+			var r, g, b, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, b, a, n = r+pr, g+pg, b+pb, a+pa, n+1
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{
+				uint8(r / n >> 8), uint8(g / n >> 8), uint8(b / n >> 8), uint8(a / n >> 8),
+			})
+		}
+	}
+	return dst
+}
+
+func renderThumbnail(content []byte, size int) ([]byte, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	frame, _, err := image.Decode(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	canvas := image.NewRGBA(image.Rect(0, 0, config.Width, config.Height))
+	draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Src)
+
+	width, height := fitWithin(config.Width, config.Height, size)
+	var buff bytes.Buffer
+	if err = png.Encode(&buff, scaleImage(canvas, width, height)); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+// derivativeKey identifies thumbnails and resized variants of uuid by the
+// hash of its content, so GIFs sharing a blob also share their derivatives.
+func derivativeKey(tx *bolt.Tx, uuid []byte) []byte {
+	pointer := tx.Bucket([]byte(root)).Get(uuid)
+	if hash, ok := blobHash(pointer); ok {
+		return append([]byte{}, hash...)
+	} else if pointer != nil {
+		return []byte(contentHash(pointer))
+	}
+	return nil
+}
+
+func deleteDerivatives(tx *bolt.Tx, hash []byte) error {
+	thumbnails := tx.Bucket([]byte(thumbnailsBucketName))
+	if thumbnails != nil && hash != nil {
+		if err := thumbnails.Delete(hash); err != nil {
+			return err
+		}
+	}
+	return deleteVariants(tx, hash)
+}
+
+// ensureThumbnail returns the cached thumbnail for uuid, rendering and
+// storing it first if needed. A nil thumbnail means uuid does not exist.
+func ensureThumbnail(db *bolt.DB, uuid []byte, size int) ([]byte, error) {
+	var key, thumbnail, content []byte
+	err := db.View(func(tx *bolt.Tx) error {
+		if key = derivativeKey(tx, uuid); key == nil {
+			return nil
+		}
+		if thumbnails := tx.Bucket([]byte(thumbnailsBucketName)); thumbnails != nil {
+			if cached := thumbnails.Get(key); cached != nil {
+				thumbnail = append([]byte{}, cached...)
+				return nil
+			}
+		}
+		content = append([]byte{}, readBlob(tx, uuid)...)
+		return nil
+	})
+	if err != nil || key == nil || thumbnail != nil {
+		return thumbnail, err
+	}
+
+	if thumbnail, err = renderThumbnail(content, size); err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		thumbnails, err := tx.CreateBucketIfNotExists([]byte(thumbnailsBucketName))
+		if err != nil {
+			return err
+		}
+		return thumbnails.Put(key, thumbnail)
+	})
+	return thumbnail, err
+}
+
+func showThumbnail(db *bolt.DB, c web.C, w http.ResponseWriter, r *http.Request) {
+	uuid := c.URLParams["uuid"]
+	var quarantined bool
+	db.View(func(tx *bolt.Tx) error {
+		quarantined = isQuarantined(tx, []byte(uuid))
+		return nil
+	})
+	if quarantined {
+		response(
+			http.StatusUnavailableForLegalReasons,
+			requestError{fmt.Sprintf("%s is awaiting moderation", uuid)},
+			c, w, r,
+		)
+		return
+	}
+
+	thumbnail, err := ensureThumbnail(db, []byte(uuid), intSetting(c, "thumbnail-size", defaultThumbnailSize))
+	if err != nil {
+		errorHandler(err, c, w, r)
+		return
+	} else if thumbnail == nil {
+		notFound(fmt.Sprintf("%s does not exist", uuid), c, w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(thumbnail)
+}
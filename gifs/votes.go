@@ -0,0 +1,174 @@
+package gifs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/csaunders/giftd/middleware"
+	"github.com/csaunders/giftd/models"
+	"github.com/zenazn/goji/web"
+)
+
+// Votes are kept in a bucket per GIF keyed by voter, so changing a vote
+// replaces the earlier one rather than adding to it.
+const votesBucketName string = "giftd-votes"
+const voterCookie string = "giftd-voter"
+const defaultVoteWeightPercent int = 10
+const defaultAnonymousVoteRateLimit int = 30
+
+var errInvalidVoter error = errors.New("invalid voter id")
+var errAnonymousVoting error = errors.New("anonymous voting is disabled")
+
+func signVoter(secret, id string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// voterIdentity identifies who is voting. Callers with a token vote as their
+// account. When anonymous-voting is set, anonymous callers carry an id signed
+// with vote-secret, and are issued one on their first vote.
+//
+// Anyone can get a new id by dropping the cookie, so an anonymous caller can
+// vote as often as they can mint ids. Anonymous votes, including the ones
+// that mint an id, are therefore limited to anonymous-vote-rate-limit an
+// hour for each remote address, but that only slows down a caller with many
+// addresses.
+func voterIdentity(db *bolt.DB, c web.C, w http.ResponseWriter, r *http.Request) (string, error) {
+	if account, ok := c.Env[middleware.AccountDetails].(models.Account); ok && len(account.Id) > 0 {
+		return "account:" + account.Id, nil
+	}
+	enabled, _ := c.Env["anonymous-voting"].(bool)
+	secret, ok := c.Env["vote-secret"].(string)
+	if !enabled || !ok || len(secret) <= 0 {
+		return "", errAnonymousVoting
+	}
+	limit := intSetting(c, "anonymous-vote-rate-limit", defaultAnonymousVoteRateLimit)
+	err := db.Update(func(tx *bolt.Tx) error {
+		return throttleReporter(tx, "vote:"+reporterIdentity(c, r), limit, time.Now().UTC())
+	})
+	if err != nil {
+		return "", err
+	}
+	if cookie, err := r.Cookie(voterCookie); err == nil {
+		parts := strings.SplitN(cookie.Value, ".", 2)
+		if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(signVoter(secret, parts[0]))) {
+			return "", errInvalidVoter
+		}
+		return "anonymous:" + parts[0], nil
+	}
+
+	id, err := models.GenUUID()
+	if err != nil {
+		return "", err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     voterCookie,
+		Value:    id + "." + signVoter(secret, id),
+		Path:     "/gifs",
+		MaxAge:   365 * 24 * 60 * 60,
+		HttpOnly: true,
+	})
+	return "anonymous:" + id, nil
+}
+
+// recordVote stores vote, one of -1, 0 or +1, as voter's vote on uuid and
+// returns the GIF's new score. A vote of 0 withdraws an earlier vote.
+func recordVote(db *bolt.DB, uuid []byte, voter string, vote int) (int, error) {
+	var score int
+	err := db.Update(func(tx *bolt.Tx) error {
+		meta, found, err := readMetadata(tx, uuid)
+		if err != nil {
+			return err
+		} else if !found {
+			return models.RecordNotFound
+		}
+		votes, err := tx.CreateBucketIfNotExists([]byte(votesBucketName))
+		if err != nil {
+			return err
+		}
+		votesForGif, err := votes.CreateBucketIfNotExists(uuid)
+		if err != nil {
+			return err
+		}
+
+		previous := 0
+		if data := votesForGif.Get([]byte(voter)); data != nil {
+			if previous, err = strconv.Atoi(string(data)); err != nil {
+				return err
+			}
+		}
+		if vote == 0 {
+			err = votesForGif.Delete([]byte(voter))
+		} else {
+			err = votesForGif.Put([]byte(voter), []byte(strconv.Itoa(vote)))
+		}
+		if err != nil {
+			return err
+		}
+		meta.Score += vote - previous
+		score = meta.Score
+		return writeMetadata(tx, uuid, meta)
+	})
+	return score, err
+}
+
+func clearVotes(tx *bolt.Tx, uuid []byte) error {
+	votes := tx.Bucket([]byte(votesBucketName))
+	if votes == nil || votes.Bucket(uuid) == nil {
+		return nil
+	}
+	return votes.DeleteBucket(uuid)
+}
+
+func voteGif(db *bolt.DB, c web.C, w http.ResponseWriter, r *http.Request) {
+	uuid := c.URLParams["uuid"]
+	var params struct {
+		Vote int `json:"vote"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil || params.Vote < -1 || params.Vote > 1 {
+		response(http.StatusNotAcceptable, requestError{"vote must be 1, -1 or 0"}, c, w, r)
+		return
+	}
+	voter, err := voterIdentity(db, c, w, r)
+	switch err {
+	case nil:
+	case errInvalidVoter:
+		response(http.StatusForbidden, requestError{err.Error()}, c, w, r)
+		return
+	case errAnonymousVoting:
+		response(http.StatusUnauthorized, requestError{"Access Denied"}, c, w, r)
+		return
+	case errRateLimited:
+		response(http.StatusTooManyRequests, requestError{"Too many votes, try again later"}, c, w, r)
+		return
+	default:
+		errorHandler(err, c, w, r)
+		return
+	}
+
+	score, err := recordVote(db, []byte(uuid), voter, params.Vote)
+	switch err {
+	case nil:
+		response(
+			http.StatusOK, struct {
+				UUID  string `json:"uuid"`
+				Score int    `json:"score"`
+			}{uuid, score},
+			c, w, r,
+		)
+	case models.RecordNotFound:
+		notFound(fmt.Sprintf("%s does not exist", uuid), c, w, r)
+	default:
+		errorHandler(err, c, w, r)
+	}
+}
@@ -0,0 +1,46 @@
+package gifs
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/csaunders/giftd/middleware"
+)
+
+func TestAnonymousVoting(t *testing.T) {
+	db := openTestDB(t)
+	if _, _, err := storeGif(db, []byte("reactions"), []byte("gif-0"), encodeGif(t, 10, 10, 1), Metadata{}); err != nil {
+		t.Fatal(err)
+	}
+	vote := func(settings map[string]interface{}) int {
+		c := testContext(map[string]string{"uuid": "gif-0"})
+		delete(c.Env, middleware.AccountDetails)
+		for key, value := range settings {
+			c.Env[key] = value
+		}
+		w := httptest.NewRecorder()
+		voteGif(db, c, w, httptest.NewRequest("POST", "/gifs/account/gif-0/vote", strings.NewReader(`{"vote": 1}`)))
+		return w.Code
+	}
+
+	if code := vote(map[string]interface{}{"vote-secret": "secret"}); code != http.StatusUnauthorized {
+		t.Errorf("without anonymous-voting: status %d, want %d", code, http.StatusUnauthorized)
+	}
+
+	// Every vote comes without a cookie, minting a new voter id each time.
+	settings := map[string]interface{}{
+		"anonymous-voting":          true,
+		"vote-secret":               "secret",
+		"anonymous-vote-rate-limit": float64(3),
+	}
+	for i := 0; i < 3; i++ {
+		if code := vote(settings); code != http.StatusOK {
+			t.Fatalf("vote %d: status %d, want %d", i, code, http.StatusOK)
+		}
+	}
+	if code := vote(settings); code != http.StatusTooManyRequests {
+		t.Errorf("vote over the limit: status %d, want %d", code, http.StatusTooManyRequests)
+	}
+}
@@ -0,0 +1,397 @@
+package gifs
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// The weights bucket keeps a Fenwick tree of GIF weights for every namespace,
+// laid over its positions index, so an untagged weighted or fresh pick reads
+// O(log n) entries rather than decoding every GIF in the namespace. Each tree
+// has a values bucket mapping positions to weights, and a sums bucket holding
+// the tree's partial sums. The trees follow the positions index as GIFs are
+// added, removed and re-weighed, and are rebuilt by the first pick after the
+// settings they were built with change.
+const weightsBucketName string = "giftd-weights"
+const weightParamsKey string = "params"
+const valuesBucketName string = "values"
+const sumsBucketName string = "sums"
+
+// Fresh weights are stored as they stood when the index was built, so that
+// they need not change as GIFs age. GIFs without an upload time are kept in
+// a tree of their own, since they are never decayed. The index is rebuilt
+// once it is this many half-lives old, before new uploads outgrow the range
+// in which weights can be compared.
+const undatedTreeName string = "undated"
+const maxIndexHalfLives float64 = 32
+
+var weightTreeNames = []string{strategyWeighted, strategyFresh, undatedTreeName}
+
+// weightParams holds the settings weights are worked out with.
+type weightParams struct {
+	VoteWeightPercent int       `json:"vote-weight-percent"`
+	HalfLifeHours     int       `json:"fresh-half-life-hours"`
+	BuiltAt           time.Time `json:"built-at,omitempty"`
+}
+
+func (p weightParams) voted(meta Metadata) float64 {
+	weight := defaultWeight
+	if meta.Weight > 0 {
+		weight = meta.Weight
+	}
+	return weight * math.Pow(1+float64(p.VoteWeightPercent)/100, float64(meta.Score))
+}
+
+// decay halves a weight for every half-life from uploadedAt until now. GIFs
+// without an upload time are not decayed.
+func (p weightParams) decay(uploadedAt, now time.Time) float64 {
+	if uploadedAt.IsZero() {
+		return 1
+	}
+	return math.Pow(0.5, now.Sub(uploadedAt).Hours()/float64(p.HalfLifeHours))
+}
+
+// current reports whether an index built with p can serve picks made with
+// settings at now.
+func (p weightParams) current(settings weightParams, now time.Time) bool {
+	return p.VoteWeightPercent == settings.VoteWeightPercent &&
+		p.HalfLifeHours == settings.HalfLifeHours &&
+		now.Sub(p.BuiltAt).Hours() < maxIndexHalfLives*float64(p.HalfLifeHours)
+}
+
+// indexed returns the weight each tree holds for meta.
+func (p weightParams) indexed(meta Metadata) []float64 {
+	voted := math.Max(p.voted(meta), minWeight)
+	if meta.UploadedAt.IsZero() {
+		return []float64{voted, 0, voted}
+	}
+	return []float64{voted, math.Max(voted/p.decay(p.BuiltAt, meta.UploadedAt), minWeight), 0}
+}
+
+// weightTree is a Fenwick tree over the weights of a namespace's GIFs. While
+// sampling, changes to its sums are kept in overlay instead of being stored.
+type weightTree struct {
+	values  *bolt.Bucket
+	sums    *bolt.Bucket
+	overlay map[int]float64
+}
+
+func encodeWeight(weight float64) []byte {
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, math.Float64bits(weight))
+	return value
+}
+
+func decodeWeight(value []byte) float64 {
+	if value == nil {
+		return 0
+	}
+	return math.Float64frombits(binary.BigEndian.Uint64(value))
+}
+
+func (t *weightTree) size() int {
+	last, _ := t.values.Cursor().Last()
+	if last == nil {
+		return 0
+	}
+	return decodePosition(last) + 1
+}
+
+func (t *weightTree) value(position int) float64 {
+	return decodeWeight(t.values.Get(encodePosition(position)))
+}
+
+// sum returns the partial sum at node i, counting from 1, which covers the
+// weights at positions i-(i&-i) to i-1.
+func (t *weightTree) sum(i int) float64 {
+	return decodeWeight(t.sums.Get(encodePosition(i))) + t.overlay[i]
+}
+
+// prefix returns the total weight of the positions before position.
+func (t *weightTree) prefix(position int) float64 {
+	total := 0.0
+	for i := position; i > 0; i -= i & -i {
+		total += t.sum(i)
+	}
+	return total
+}
+
+func (t *weightTree) add(position int, delta float64) error {
+	size := t.size()
+	for i := position + 1; i <= size; i += i & -i {
+		if t.overlay != nil {
+			t.overlay[i] += delta
+		} else if err := t.sums.Put(encodePosition(i), encodeWeight(t.sum(i)+delta)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// set changes the weight at position, appending it when position is one
+// past the end of the tree.
+func (t *weightTree) set(position int, weight float64) error {
+	if position < t.size() {
+		delta := weight - t.value(position)
+		if err := t.values.Put(encodePosition(position), encodeWeight(weight)); err != nil {
+			return err
+		}
+		return t.add(position, delta)
+	}
+	i := position + 1
+	sum := weight + t.prefix(position) - t.prefix(i-(i&-i))
+	if err := t.values.Put(encodePosition(position), encodeWeight(weight)); err != nil {
+		return err
+	}
+	return t.sums.Put(encodePosition(i), encodeWeight(sum))
+}
+
+// truncate drops the last position from the tree.
+func (t *weightTree) truncate() error {
+	size := t.size()
+	if size <= 0 {
+		return nil
+	}
+	if err := t.values.Delete(encodePosition(size - 1)); err != nil {
+		return err
+	}
+	return t.sums.Delete(encodePosition(size))
+}
+
+// search returns the position at which the running total of the weights
+// passes target.
+func (t *weightTree) search(target float64, size int) int {
+	step := 1
+	for step*2 <= size {
+		step *= 2
+	}
+	position := 0
+	for ; step > 0; step /= 2 {
+		if next := position + step; next <= size && t.sum(next) <= target {
+			position = next
+			target -= t.sum(next)
+		}
+	}
+	return position
+}
+
+// weightsFor returns the weight trees of ns, in the order of
+// weightTreeNames, and the settings they were built with. The trees are nil
+// if ns has no weight index.
+func weightsFor(tx *bolt.Tx, ns []byte) ([]*weightTree, weightParams) {
+	var params weightParams
+	weights := tx.Bucket([]byte(weightsBucketName))
+	if weights == nil || weights.Bucket(ns) == nil {
+		return nil, params
+	}
+	weightsForNamespace := weights.Bucket(ns)
+	if err := json.Unmarshal(weightsForNamespace.Get([]byte(weightParamsKey)), &params); err != nil {
+		return nil, params
+	}
+	trees := make([]*weightTree, len(weightTreeNames))
+	for i, name := range weightTreeNames {
+		tree := weightsForNamespace.Bucket([]byte(name))
+		if tree == nil {
+			return nil, params
+		}
+		trees[i] = &weightTree{values: tree.Bucket([]byte(valuesBucketName)), sums: tree.Bucket([]byte(sumsBucketName))}
+	}
+	return trees, params
+}
+
+// weighGif records the weight of uuid, which must already be indexed at
+// position, in the weight index of ns.
+func weighGif(tx *bolt.Tx, ns, uuid []byte, position int) error {
+	trees, params := weightsFor(tx, ns)
+	if trees == nil {
+		return nil
+	}
+	var meta Metadata
+	if err := json.Unmarshal(tx.Bucket([]byte(root)).Bucket(ns).Get(uuid), &meta); err != nil {
+		return err
+	}
+	for i, weight := range params.indexed(meta) {
+		if err := trees[i].set(position, weight); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reweighGif updates the weight of uuid after its metadata has changed.
+func reweighGif(tx *bolt.Tx, ns, uuid []byte) error {
+	_, offsets := positionsFor(tx, ns)
+	if offsets == nil || offsets.Get(uuid) == nil {
+		return nil
+	}
+	return weighGif(tx, ns, uuid, decodePosition(offsets.Get(uuid)))
+}
+
+// removeWeight moves the last weight into position, which is emptied, the
+// same way removePosition moves the last slot.
+func removeWeight(tx *bolt.Tx, ns []byte, position int) error {
+	trees, _ := weightsFor(tx, ns)
+	for _, tree := range trees {
+		if last := tree.size() - 1; position < last {
+			if err := tree.set(position, tree.value(last)); err != nil {
+				return err
+			}
+		}
+		if err := tree.truncate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func dropWeights(tx *bolt.Tx, ns []byte) error {
+	weights := tx.Bucket([]byte(weightsBucketName))
+	if weights == nil || weights.Bucket(ns) == nil {
+		return nil
+	}
+	return weights.DeleteBucket(ns)
+}
+
+// indexWeights builds the weight index of ns, which must have a positions
+// index, with params.
+func indexWeights(tx *bolt.Tx, ns []byte, params weightParams) error {
+	if err := dropWeights(tx, ns); err != nil {
+		return err
+	}
+	weights, err := tx.CreateBucketIfNotExists([]byte(weightsBucketName))
+	if err != nil {
+		return err
+	}
+	weightsForNamespace, err := weights.CreateBucket(ns)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	if err = weightsForNamespace.Put([]byte(weightParamsKey), data); err != nil {
+		return err
+	}
+	for _, name := range weightTreeNames {
+		tree, err := weightsForNamespace.CreateBucket([]byte(name))
+		if err != nil {
+			return err
+		}
+		if _, err = tree.CreateBucket([]byte(valuesBucketName)); err != nil {
+			return err
+		}
+		if _, err = tree.CreateBucket([]byte(sumsBucketName)); err != nil {
+			return err
+		}
+	}
+	slots, _ := positionsFor(tx, ns)
+	return slots.ForEach(func(key, uuid []byte) error {
+		return weighGif(tx, ns, uuid, decodePosition(key))
+	})
+}
+
+// scaledTree is a weight tree whose weights are multiplied by scale.
+type scaledTree struct {
+	*weightTree
+	scale float64
+}
+
+// sampleWeights picks up to num distinct GIFs from ns without replacement,
+// each with probability proportional to its weight under strategy at now.
+func sampleWeights(tx *bolt.Tx, ns []byte, trees []*weightTree, params weightParams, strategy string, num int, rng *rand.Rand, now time.Time) []string {
+	scaled := []scaledTree{{trees[0], 1}}
+	if strategy == strategyFresh {
+		scaled = []scaledTree{{trees[1], params.decay(params.BuiltAt, now)}, {trees[2], 1}}
+	}
+	for _, tree := range scaled {
+		tree.overlay = map[int]float64{}
+	}
+
+	size := positionCount(tx, ns)
+	uuids := []string{}
+	picked := map[int]bool{}
+	// Rounding can leave a little weight behind for GIFs already picked, so
+	// a handful of draws landing on them is tolerated before giving up.
+	for misses := 0; len(uuids) < num && len(picked) < size && misses < 8; {
+		total := 0.0
+		for _, tree := range scaled {
+			total += tree.scale * tree.prefix(size)
+		}
+		if !(total > 0) {
+			break
+		}
+		target := rng.Float64() * total
+		position := size
+		for _, tree := range scaled {
+			weight := tree.scale * tree.prefix(size)
+			if target < weight {
+				position = tree.search(target/tree.scale, size)
+				break
+			}
+			target -= weight
+		}
+		if position >= size || picked[position] {
+			misses++
+			continue
+		}
+		picked[position] = true
+		for _, tree := range scaled {
+			tree.add(position, -tree.value(position))
+		}
+		uuids = append(uuids, string(gifAtPosition(tx, ns, position)))
+	}
+	return uuids
+}
+
+// findIndexedWeightedGifs picks up to num GIFs from namespace with strategy,
+// as findWeightedGifs would, using the namespace's weight index. The index
+// is built first if it is missing or out of date.
+func findIndexedWeightedGifs(db *bolt.DB, namespace []byte, num int, strategy string, settings weightParams, rng *rand.Rand) ([]string, error) {
+	var uuids []string
+	now := time.Now()
+	indexed := true
+	err := db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(root)).Bucket(namespace) == nil {
+			return errors.New("findIndexedWeightedGifs: bucket does not exist")
+		}
+		trees, params := weightsFor(tx, namespace)
+		if indexed = trees != nil && params.current(settings, now); !indexed {
+			return nil
+		}
+		uuids = sampleWeights(tx, namespace, trees, params, strategy, num, rng, now)
+		return nil
+	})
+	if err == nil && !indexed {
+		if err = indexWeightsFor(db, namespace, settings, now); err == nil {
+			return findIndexedWeightedGifs(db, namespace, num, strategy, settings, rng)
+		}
+	}
+	return uuids, err
+}
+
+// indexWeightsFor builds the weight index of ns, unless another request has
+// already done so.
+func indexWeightsFor(db *bolt.DB, ns []byte, settings weightParams, now time.Time) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(root)).Bucket(ns) == nil {
+			return errors.New("indexWeightsFor: bucket does not exist")
+		}
+		if trees, params := weightsFor(tx, ns); trees != nil && params.current(settings, now) {
+			return nil
+		}
+		if positionCount(tx, ns) < 0 {
+			if err := indexNamespace(tx, ns); err != nil {
+				return err
+			}
+		}
+		settings.BuiltAt = now.UTC()
+		return indexWeights(tx, ns, settings)
+	})
+}
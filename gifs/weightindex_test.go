@@ -0,0 +1,141 @@
+package gifs
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// checkWeights verifies that every tree in the weight index of ns holds the
+// weight of the GIF at each position, and that its partial sums add up.
+func checkWeights(t *testing.T, tx *bolt.Tx, ns []byte) {
+	t.Helper()
+	trees, params := weightsFor(tx, ns)
+	if trees == nil {
+		t.Fatal("namespace has no weight index")
+	}
+	size := positionCount(tx, ns)
+	for i, tree := range trees {
+		if tree.size() != size {
+			t.Fatalf("%s tree holds %d weights, want %d", weightTreeNames[i], tree.size(), size)
+		}
+		total := 0.0
+		for position := 0; position < size; position++ {
+			var meta Metadata
+			uuid := gifAtPosition(tx, ns, position)
+			if err := json.Unmarshal(tx.Bucket([]byte(root)).Bucket(ns).Get(uuid), &meta); err != nil {
+				t.Fatal(err)
+			}
+			want := params.indexed(meta)[i]
+			if got := tree.value(position); math.Abs(got-want) > 1e-9 {
+				t.Fatalf("%s weight of %s = %v, want %v", weightTreeNames[i], uuid, got, want)
+			}
+			total += want
+			if got := tree.prefix(position + 1); math.Abs(got-total) > 1e-9 {
+				t.Fatalf("%s total through position %d = %v, want %v", weightTreeNames[i], position, got, total)
+			}
+		}
+	}
+}
+
+func TestWeightIndexFollowsWrites(t *testing.T) {
+	db := openTestDB(t)
+	ns := []byte("reactions")
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		meta := Metadata{}
+		if i%3 != 0 {
+			meta.UploadedAt = now.Add(-time.Duration(i) * 24 * time.Hour)
+		}
+		if _, _, err := storeGif(db, ns, []byte(fmt.Sprintf("gif-%d", i)), encodeGif(t, 10+i, 10, 1), meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+	settings := weightParams{VoteWeightPercent: 10, HalfLifeHours: 24}
+	if err := indexWeightsFor(db, ns, settings, now); err != nil {
+		t.Fatal(err)
+	}
+	check := func(step string) {
+		db.View(func(tx *bolt.Tx) error {
+			t.Run(step, func(t *testing.T) { checkWeights(t, tx, ns) })
+			return nil
+		})
+	}
+	check("built")
+
+	for i, weight := range []float64{4, 0.5, 2} {
+		if err := SetWeight(db, fmt.Sprintf("gif-%d", i*3+1), weight); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check("weights set")
+
+	for _, uuid := range []string{"gif-4", "gif-9", "gif-0"} {
+		err := db.Update(func(tx *bolt.Tx) error {
+			return removeFromNamespace(tx, ns, []byte(uuid))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check("removed")
+
+	if _, _, err := storeGif(db, ns, []byte("gif-10"), encodeGif(t, 30, 10, 1), Metadata{UploadedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+	check("added")
+}
+
+func TestFindIndexedWeightedGifs(t *testing.T) {
+	db := openTestDB(t)
+	ns := []byte("reactions")
+	now := time.Now()
+	gifs := []struct {
+		uuid string
+		meta Metadata
+	}{
+		{"light", Metadata{Weight: 1, UploadedAt: now}},
+		{"heavy", Metadata{Weight: 9, UploadedAt: now}},
+		{"stale", Metadata{Weight: 9, UploadedAt: now.Add(-30 * 24 * time.Hour)}},
+	}
+	for i, gif := range gifs {
+		if _, _, err := storeGif(db, ns, []byte(gif.uuid), encodeGif(t, 10+i, 10, 1), gif.meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+	settings := weightParams{VoteWeightPercent: 10, HalfLifeHours: 24}
+	rng := rand.New(rand.NewSource(1))
+
+	const picks = 4000
+	counts := map[string]int{}
+	for i := 0; i < picks; i++ {
+		uuids, err := findIndexedWeightedGifs(db, ns, 1, strategyFresh, settings, rng)
+		if err != nil || len(uuids) != 1 {
+			t.Fatalf("pick %d: %v, %v", i, uuids, err)
+		}
+		counts[uuids[0]]++
+	}
+	if heavy := float64(counts["heavy"]) / picks; math.Abs(heavy-0.9) > 0.03 {
+		t.Errorf("heavy picked %.3f of the time, want 0.9", heavy)
+	}
+	if counts["stale"] > 0 {
+		t.Errorf("stale picked %d times, want 0", counts["stale"])
+	}
+
+	uuids, err := findIndexedWeightedGifs(db, ns, 5, strategyWeighted, settings, rng)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	for _, uuid := range uuids {
+		seen[uuid] = true
+	}
+	if len(uuids) != len(gifs) || len(seen) != len(gifs) {
+		t.Errorf("picked %v, want each of the %d GIFs once", uuids, len(gifs))
+	}
+}
@@ -0,0 +1,187 @@
+package gifs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/csaunders/giftd/models"
+	"github.com/zenazn/goji/web"
+)
+
+const strategyUniform string = "uniform"
+const strategyWeighted string = "weighted"
+const strategyFresh string = "fresh"
+
+const defaultWeight float64 = 1
+const defaultHalfLifeHours int = 168
+
+// Weights are floored so that a GIF never becomes impossible to pick, and
+// so that fresh picks still work in a namespace where everything is old.
+const minWeight float64 = 1e-9
+
+// ErrInvalidWeight is returned by SetWeight for negative or non-finite
+// weights.
+var ErrInvalidWeight error = errors.New("weight must be a positive number")
+
+// weigher returns how likely a GIF is to be picked relative to the others.
+type weigher func(meta Metadata) float64
+
+func validStrategy(strategy string) bool {
+	return strategy == strategyUniform || strategy == strategyWeighted || strategy == strategyFresh
+}
+
+// randomStrategy returns the strategy requested by ?strategy=, falling back
+// to the namespace's default.
+func randomStrategy(db *bolt.DB, c web.C, r *http.Request, namespace string) (string, error) {
+	strategy := r.URL.Query().Get("strategy")
+	if len(strategy) <= 0 {
+		strategy = defaultStrategy(db, c, namespace)
+	}
+	if !validStrategy(strategy) {
+		return "", contentError{
+			http.StatusNotAcceptable,
+			fmt.Sprintf("strategy must be %s, %s or %s", strategyUniform, strategyWeighted, strategyFresh),
+		}
+	}
+	return strategy, nil
+}
+
+// defaultStrategy returns the strategy set in the namespace's metadata,
+// falling back to the random-strategies setting and then random-strategy.
+func defaultStrategy(db *bolt.DB, c web.C, namespace string) string {
+	var info NamespaceInfo
+	db.View(func(tx *bolt.Tx) error {
+		info, _, _ = readNamespaceInfo(tx, []byte(namespace))
+		return nil
+	})
+	if validStrategy(info.RandomStrategy) {
+		return info.RandomStrategy
+	}
+	if strategies, ok := c.Env["random-strategies"].(map[string]interface{}); ok {
+		if strategy, ok := strategies[namespace].(string); ok && validStrategy(strategy) {
+			return strategy
+		}
+	}
+	if strategy, ok := c.Env["random-strategy"].(string); ok && validStrategy(strategy) {
+		return strategy
+	}
+	return strategyUniform
+}
+
+// weightSettings returns the settings weighted and fresh picks are made
+// with.
+func weightSettings(c web.C) weightParams {
+	return weightParams{
+		VoteWeightPercent: intSetting(c, "vote-weight-percent", defaultVoteWeightPercent),
+		HalfLifeHours:     intSetting(c, "fresh-half-life-hours", defaultHalfLifeHours),
+	}
+}
+
+// weigherFor returns the weigher for strategy, or nil for uniform picks.
+// Weighted picks weigh a GIF by its manual weight, scaled up or down by
+// vote-weight-percent for every point of its vote score. Fresh picks also
+// halve that for every half-life since it was uploaded.
+func weigherFor(c web.C, strategy string) weigher {
+	settings := weightSettings(c)
+	switch strategy {
+	case strategyWeighted:
+		return settings.voted
+	case strategyFresh:
+		now := time.Now()
+		return func(meta Metadata) float64 {
+			return settings.voted(meta) * settings.decay(meta.UploadedAt, now)
+		}
+	default:
+		return nil
+	}
+}
+
+type weightedKey struct {
+	UUID string
+	Key  float64
+}
+
+// weightedSample picks up to num distinct GIFs from bucketForNamespace
+// without replacement, each with probability proportional to its weight.
+// When candidates is not nil only those uuids are considered. Every GIF
+// considered is decoded, so untagged picks use findIndexedWeightedGifs.
+func weightedSample(bucketForNamespace *bolt.Bucket, num int, candidates []string, weigh weigher, rng *rand.Rand) ([]string, error) {
+	keys := []weightedKey{}
+	consider := func(uuid, data []byte) error {
+		var meta Metadata
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return err
+		}
+		weight := math.Max(weigh(meta), minWeight)
+		// The num largest values of u^(1/w), compared here by their
+		// logarithms, form a weighted sample without replacement.
+		keys = append(keys, weightedKey{string(uuid), math.Log(rng.Float64()) / weight})
+		return nil
+	}
+	if candidates == nil {
+		if err := bucketForNamespace.ForEach(consider); err != nil {
+			return []string{}, err
+		}
+	}
+	for _, uuid := range candidates {
+		if data := bucketForNamespace.Get([]byte(uuid)); data != nil {
+			if err := consider([]byte(uuid), data); err != nil {
+				return []string{}, err
+			}
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Key > keys[j].Key
+	})
+	uuids := []string{}
+	for _, key := range keys {
+		if len(uuids) >= num {
+			break
+		}
+		uuids = append(uuids, key.UUID)
+	}
+	return uuids, nil
+}
+
+func findWeightedGifs(db *bolt.DB, namespace []byte, num int, candidates []string, weigh weigher, rng *rand.Rand) ([]string, error) {
+	var uuids []string
+	err := db.View(func(tx *bolt.Tx) error {
+		bucketForNamespace := tx.Bucket([]byte(root)).Bucket(namespace)
+		if bucketForNamespace == nil {
+			return fmt.Errorf("findWeightedGifs: bucket does not exist")
+		}
+		var err error
+		uuids, err = weightedSample(bucketForNamespace, num, candidates, weigh, rng)
+		return err
+	})
+	if err != nil {
+		return []string{}, err
+	}
+	return uuids, nil
+}
+
+// SetWeight changes how likely uuid is to be picked by weighted and fresh
+// random selection. A weight of 0 restores the default.
+func SetWeight(db *bolt.DB, uuid string, weight float64) error {
+	if weight < 0 || math.IsNaN(weight) || math.IsInf(weight, 0) {
+		return ErrInvalidWeight
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		meta, found, err := readMetadata(tx, []byte(uuid))
+		if err != nil {
+			return err
+		} else if !found {
+			return models.RecordNotFound
+		}
+		meta.Weight = weight
+		return writeMetadata(tx, []byte(uuid), meta)
+	})
+}
@@ -0,0 +1,31 @@
+package gifs
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/zenazn/goji/web"
+)
+
+func TestFreshWeigher(t *testing.T) {
+	c := web.C{Env: map[interface{}]interface{}{"fresh-half-life-hours": float64(24)}}
+	weigh := weigherFor(c, strategyFresh)
+
+	cases := []struct {
+		name string
+		meta Metadata
+		want float64
+	}{
+		{"new", Metadata{UploadedAt: time.Now()}, 1},
+		{"one half-life old", Metadata{UploadedAt: time.Now().Add(-24 * time.Hour)}, 0.5},
+		{"two half-lives old", Metadata{UploadedAt: time.Now().Add(-48 * time.Hour)}, 0.25},
+		{"no upload time", Metadata{}, 1},
+		{"no upload time, weighted", Metadata{Weight: 3}, 3},
+	}
+	for _, tc := range cases {
+		if got := weigh(tc.meta); math.Abs(got-tc.want) > 1e-6 {
+			t.Errorf("%s: weight %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
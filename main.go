@@ -22,6 +22,7 @@ const giftdConfig string = "giftd.json"
 
 var permissions map[string]string = map[string]string{
 	`/gifs/[a-z]+/random`:             "public",
+	`/gifs/[a-z]+/daily`:              "public",
 	`/gifs/.{8}-.{4}-.{4}-.{4}-.{12}`: "public",
 	`/gifs.*`:                         "gifs-api",
 	`/admin.*`:                        "admin-api",
@@ -103,12 +104,15 @@ func main() {
 	gifs.Register("/gifs", middleware.EnvironmentDatabaseProvider)
 	admin.Register("/admin")
 
-	configMiddleware, err := middleware.InitializeConfiguration(giftdConfig, confDb)
+	config, err := middleware.LoadConfiguration(giftdConfig, confDb)
 	if err != nil {
 		fmt.Println(err)
 	}
+	if err = gifs.ResumeImports(confDb, config); err != nil {
+		fmt.Println(err)
+	}
 
-	goji.Use(configMiddleware)
+	goji.Use(middleware.ConfigurationMiddleware(config))
 	goji.Use(middleware.APIAccessManagement)
 	goji.Use(middleware.DatastoreLoader)
 	goji.Serve()
@@ -85,42 +85,49 @@ func CreateAdministrator(db *bolt.DB) (string, error) {
 	return "", nil
 }
 
-func hasSufficientPermissions(requiredPerms, actualPerms string) bool {
-	fmt.Println("reqd:", requiredPerms, "actual:", actualPerms)
+// hasSufficientPermissions checks the account's permissions against the
+// comma separated scopes a path requires. Accounts holding namespaced
+// permissions such as gifs:write:reactions satisfy the matching gifs-api
+// scope when they have the access the method needs in some namespace; the
+// handlers then check the namespace itself.
+func hasSufficientPermissions(requiredPerms string, account models.Account, method string) bool {
 	if strings.Contains(requiredPerms, "public") {
 		return true
 	}
 
-	if strings.Contains(actualPerms, "admin") {
+	if account.HasPermission("admin") {
 		return true
 	}
 
-	sufficientPermissions := false
 	requiredPermsList := strings.Split(requiredPerms, ",")
 	for _, perm := range requiredPermsList {
-		if strings.Contains(actualPerms, perm) {
-			sufficientPermissions = true
-			break
+		if account.HasPermission(perm) {
+			return true
+		}
+		if service, ok := models.ServiceFor(perm); ok && account.Allows(service, models.AccessFor(method), "") {
+			return true
 		}
 	}
-	return sufficientPermissions
+	return false
 }
 
-func permissionsFor(db *bolt.DB, token string) (string, error) {
-	perms := ""
+func accountFor(db *bolt.DB, token string) (models.Account, bool, error) {
+	var account models.Account
 	err := db.View(func(tx *bolt.Tx) error {
 		bucket, err := models.ApiClientsBucket(tx)
 		if err != nil {
 			return err
 		}
-		perms = string(bucket.Get([]byte(token)))
-		return nil
+		return models.Load(bucket, token, &account)
 	})
-	return perms, err
+	if err == models.RecordNotFound {
+		return account, false, nil
+	}
+	return account, err == nil, err
 }
 
-func canAccess(db *bolt.DB, path, perms string) bool {
-	if strings.Contains(perms, "admin") {
+func canAccess(db *bolt.DB, r *http.Request, account models.Account) bool {
+	if account.HasPermission("admin") {
 		return true
 	}
 
@@ -133,8 +140,8 @@ func canAccess(db *bolt.DB, path, perms string) bool {
 
 		bucket.ForEach(func(pathPattern, requiredPerms []byte) error {
 			re := regexp.MustCompile(string(pathPattern))
-			if re.MatchString(path) {
-				access = hasSufficientPermissions(string(requiredPerms), perms)
+			if re.MatchString(r.URL.Path) {
+				access = hasSufficientPermissions(string(requiredPerms), account, r.Method)
 				if access {
 					return errors.New("")
 				}
@@ -146,21 +153,6 @@ func canAccess(db *bolt.DB, path, perms string) bool {
 	return access
 }
 
-func loadAccount(db *bolt.DB, token string, c *web.C) {
-	db.View(func(tx *bolt.Tx) error {
-		var account models.Account
-		bucket, err := models.ApiClientsBucket(tx)
-		if err != nil {
-			return err
-		}
-		if err = models.Load(bucket, token, &account); err != nil {
-			return err
-		}
-		c.Env[AccountDetails] = account
-		return nil
-	})
-}
-
 func APIAccessManagement(c *web.C, h http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		if c.Env["skipAuth"] != nil {
@@ -176,16 +168,18 @@ func APIAccessManagement(c *web.C, h http.Handler) http.Handler {
 		}
 
 		accessToken := r.Header.Get("Authorization")
-		perms, err := permissionsFor(db, accessToken)
+		account, found, err := accountFor(db, accessToken)
 
 		if err != nil {
 			deny(w)
 			return
 		}
 
-		if canAccess(db, r.URL.Path, perms) {
+		if canAccess(db, r, account) {
 			fmt.Println("Access Granted for", r.URL.Path)
-			loadAccount(db, accessToken, c)
+			if found {
+				c.Env[AccountDetails] = account
+			}
 			h.ServeHTTP(w, r)
 			return
 		}
@@ -11,10 +11,15 @@ import (
 const ConfigurationDB string = "configuration-db"
 
 func InitializeConfiguration(configPath string, configDb interface{}) (func(c *web.C, h http.Handler) http.Handler, error) {
+	config, err := LoadConfiguration(configPath, configDb)
+	return ConfigurationMiddleware(config), err
+}
+
+func LoadConfiguration(configPath string, configDb interface{}) (map[string]interface{}, error) {
 	config := map[string]interface{}{ConfigurationDB: configDb}
 
 	err := updateConfiguration(config, configPath)
-	return configurationMiddleware(config), err
+	return config, err
 }
 
 func updateConfiguration(config map[string]interface{}, configPath string) error {
@@ -35,7 +40,7 @@ func updateConfiguration(config map[string]interface{}, configPath string) error
 	return nil
 }
 
-func configurationMiddleware(config map[string]interface{}) func(c *web.C, h http.Handler) http.Handler {
+func ConfigurationMiddleware(config map[string]interface{}) func(c *web.C, h http.Handler) http.Handler {
 	return func(c *web.C, h http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			for k, v := range config {
@@ -33,19 +33,13 @@ func synchronized(fn func()) {
 	fn()
 }
 
+// store is a datastore shared by every caller that has it open. It is
+// reference counted under storeMutex and closed once the last caller is done
+// with it, so a caller can never be handed a store that is being closed.
 type store struct {
-	Db *bolt.DB
-	Wg *sync.WaitGroup
-}
-
-func datastoreCloser(name string, datastore *store) {
-	datastore.Wg.Wait()
-	synchronized(func() {
-		datastore.Db.Close()
-		if cache[name] != nil {
-			delete(cache, name)
-		}
-	})
+	Name string
+	Db   *bolt.DB
+	Refs int
 }
 
 func openDatastore(name string) (*store, error) {
@@ -54,18 +48,15 @@ func openDatastore(name string) (*store, error) {
 	synchronized(func() {
 		datastore = cache[name]
 		if datastore == nil {
-			db, err := bolt.Open(name, 0600, &bolt.Options{Timeout: 1 * time.Second})
-			if err == nil {
-				datastore = &store{}
-				datastore.Db = db
-				datastore.Wg = new(sync.WaitGroup)
-				datastore.Wg.Add(1)
-				cache[name] = datastore
-				go datastoreCloser(name, datastore)
+			var db *bolt.DB
+			db, err = bolt.Open(name, 0600, &bolt.Options{Timeout: 1 * time.Second})
+			if err != nil {
+				return
 			}
-		} else {
-			datastore.Wg.Add(1)
+			datastore = &store{Name: name, Db: db}
+			cache[name] = datastore
 		}
+		datastore.Refs++
 	})
 
 	return datastore, err
@@ -131,7 +122,27 @@ func loadDatastore(c *web.C, r *http.Request) (*store, error) {
 }
 
 func unloadDatastore(datastore *store) {
-	datastore.Wg.Done()
+	synchronized(func() {
+		datastore.Refs--
+		if datastore.Refs > 0 {
+			return
+		}
+		datastore.Db.Close()
+		if cache[datastore.Name] == datastore {
+			delete(cache, datastore.Name)
+		}
+	})
+}
+
+// WithDatastore runs fn against the named datastore, sharing the connection
+// with any requests that already have it open.
+func WithDatastore(name string, fn func(db *bolt.DB) error) error {
+	datastore, err := openDatastore(name)
+	if err != nil {
+		return err
+	}
+	defer unloadDatastore(datastore)
+	return fn(datastore.Db)
 }
 
 func DatastoreLoader(c *web.C, h http.Handler) http.Handler {
@@ -0,0 +1,83 @@
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const ReadAccess string = "read"
+const WriteAccess string = "write"
+
+// AnyNamespace is the namespace of a permission that covers every
+// namespace, as in gifs:read:*.
+const AnyNamespace string = "*"
+
+const namespaceName string = `[a-z0-9_-]+`
+
+// NamespacePattern matches the names namespaces may be given, so that every
+// namespace can be named in a permission.
+var NamespacePattern *regexp.Regexp = regexp.MustCompile(`^` + namespaceName + `$`)
+
+var scopePattern *regexp.Regexp = regexp.MustCompile(`^[a-z][a-z-]*$`)
+var scopedPermissionPattern *regexp.Regexp = regexp.MustCompile(`^(gifs):(read|write):(` + namespaceName + `|\*)$`)
+
+// InvalidPermission is returned when a permission is neither a plain scope
+// such as gifs-api nor a namespaced permission such as gifs:write:reactions.
+type InvalidPermission struct {
+	Permission string
+}
+
+func (e InvalidPermission) Error() string {
+	return fmt.Sprintf("invalid permission %q: use a scope such as gifs-api or service:read|write:namespace such as gifs:write:reactions", e.Permission)
+}
+
+func ValidatePermissions(perms []string) error {
+	for _, perm := range perms {
+		if !scopePattern.MatchString(perm) && !scopedPermissionPattern.MatchString(perm) {
+			return InvalidPermission{perm}
+		}
+	}
+	return nil
+}
+
+// AccessFor returns the access an HTTP method needs.
+func AccessFor(method string) string {
+	if method == "GET" || method == "HEAD" {
+		return ReadAccess
+	}
+	return WriteAccess
+}
+
+// Allows reports whether the account may use service with the given access
+// to namespace. Holding admin or the service's plain scope (gifs-api) allows
+// everything, and write access implies read access. An empty namespace asks
+// whether the account has access to any namespace at all, while AnyNamespace
+// requires a wildcard permission.
+func (a *Account) Allows(service, access, namespace string) bool {
+	if a.HasPermission("admin") || a.HasPermission(service+"-api") {
+		return true
+	}
+	for _, perm := range a.Permissions {
+		parts := scopedPermissionPattern.FindStringSubmatch(perm)
+		if parts == nil || parts[1] != service {
+			continue
+		}
+		if parts[2] != access && parts[2] != WriteAccess {
+			continue
+		}
+		if len(namespace) <= 0 || parts[3] == AnyNamespace || parts[3] == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// ServiceFor returns the service guarded by a plain scope, so that gifs-api
+// routes also admit accounts holding gifs:... permissions.
+func ServiceFor(scope string) (string, bool) {
+	if !strings.HasSuffix(scope, "-api") {
+		return "", false
+	}
+	return strings.TrimSuffix(scope, "-api"), true
+}
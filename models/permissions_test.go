@@ -0,0 +1,50 @@
+package models
+
+import "testing"
+
+func TestValidatePermissions(t *testing.T) {
+	valid := []string{"admin", "gifs-api", "admin-api", "gifs:read:reactions", "gifs:write:cat-gifs", "gifs:read:*", "gifs:write:*"}
+	if err := ValidatePermissions(valid); err != nil {
+		t.Errorf("ValidatePermissions(%v) = %v, want nil", valid, err)
+	}
+
+	invalid := []string{"", "Gifs-api", "gifs:read", "gifs:delete:reactions", "gifs:read:Reactions", "gifs:read:foo.bar", "admin:read:*", "gifs:read:a:b"}
+	for _, perm := range invalid {
+		err := ValidatePermissions([]string{"gifs-api", perm})
+		if invalidPerm, ok := err.(InvalidPermission); !ok || invalidPerm.Permission != perm {
+			t.Errorf("ValidatePermissions(%q) = %v, want InvalidPermission", perm, err)
+		}
+	}
+}
+
+func TestAllows(t *testing.T) {
+	cases := []struct {
+		perms     []string
+		access    string
+		namespace string
+		want      bool
+	}{
+		{[]string{"admin"}, WriteAccess, "reactions", true},
+		{[]string{"gifs-api"}, WriteAccess, AnyNamespace, true},
+		{[]string{"admin-api"}, ReadAccess, "reactions", false},
+		{[]string{"gifs:read:reactions"}, ReadAccess, "reactions", true},
+		{[]string{"gifs:read:reactions"}, WriteAccess, "reactions", false},
+		{[]string{"gifs:read:reactions"}, ReadAccess, "cats", false},
+		{[]string{"gifs:write:reactions"}, ReadAccess, "reactions", true},
+		{[]string{"gifs:write:reactions"}, WriteAccess, "reactions", true},
+		{[]string{"gifs:read:*"}, ReadAccess, "cats", true},
+		{[]string{"gifs:read:*"}, WriteAccess, "cats", false},
+		{[]string{"gifs:read:reactions"}, ReadAccess, AnyNamespace, false},
+		{[]string{"gifs:read:*"}, ReadAccess, AnyNamespace, true},
+		{[]string{"gifs:read:reactions"}, ReadAccess, "", true},
+		{[]string{"gifs:read:reactions"}, WriteAccess, "", false},
+		{[]string{"gifs:read:reactions", "gifs:write:cats"}, WriteAccess, "cats", true},
+		{[]string{}, ReadAccess, "", false},
+	}
+	for _, tc := range cases {
+		account := Account{Permissions: tc.perms}
+		if got := account.Allows("gifs", tc.access, tc.namespace); got != tc.want {
+			t.Errorf("%v Allows(gifs, %s, %q) = %v, want %v", tc.perms, tc.access, tc.namespace, got, tc.want)
+		}
+	}
+}